@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// identities without MSP ID never match
+func matchesIdentity(identities []AdminIdentity, id string) bool {
+	mspId, cn := SplitIdentity(id)
+	for _, identity := range identities {
+		if identity.MspId != "" && identity.MspId == mspId && identity.CN == cn {
+			return true
+		}
+	}
+	return false
+}
+
+// the single admin of former settings is only known by its CN, which any MSP can issue. It has no rights
+// until migrateIdentities binds it to the MSP the migration names
+func (s *Settings) isAdmin(id string) bool {
+	return matchesIdentity(s.Admins, id)
+}
+
+// turns the single admin of former settings into an admin of the MSP
+func (s *Settings) bindLegacyAdmin(mspId string) AdminIdentity {
+	admin := AdminIdentity{MspId: mspId, CN: s.Admin}
+	s.Admins = append(s.Admins, admin)
+	s.Admin = ""
+	return admin
+}
+
+func validIdentities(identities []AdminIdentity) error {
+	for _, identity := range identities {
+		if identity.MspId == "" || identity.CN == "" {
+			return errors.New("Bad request: mspId and cn are required")
+		}
+	}
+	return nil
+}
+
+// auditors may read the audit reports, admins are auditors as well
+func (s *Settings) isAuditor(id string) bool {
+	return s.isAdmin(id) || matchesIdentity(s.Auditors, id)
+}
+
+func (t *LoyaltyChaincode) putSettings(stub shim.ChaincodeStubInterface, settings Settings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(KeySettings, data)
+}
+
+func indexOfAdmin(admins []AdminIdentity, admin AdminIdentity) int {
+	for i, a := range admins {
+		if a == admin {
+			return i
+		}
+	}
+	return -1
+}
+
+// applies an add, remove or rotate to the list of admins
+func updateAdmins(admins []AdminIdentity, action string, change AdminChange) ([]AdminIdentity, error) {
+	err := validIdentities([]AdminIdentity{change.Admin})
+	if err != nil {
+		return nil, err
+	}
+
+	i := indexOfAdmin(admins, change.Admin)
+
+	switch action {
+	case "add":
+		if i >= 0 {
+			return nil, errors.New("'" + change.Admin.CN + "' is already an admin")
+		}
+		return append(admins, change.Admin), nil
+	case "remove":
+		if i < 0 {
+			return nil, errors.New("'" + change.Admin.CN + "' is not an admin")
+		}
+		if len(admins) == 1 {
+			return nil, errors.New("The last admin can't be removed")
+		}
+		return append(admins[:i], admins[i+1:]...), nil
+	case "rotate":
+		if i < 0 {
+			return nil, errors.New("'" + change.Admin.CN + "' is not an admin")
+		}
+		err = validIdentities([]AdminIdentity{change.New})
+		if err != nil {
+			return nil, err
+		}
+		if indexOfAdmin(admins, change.New) >= 0 {
+			return nil, errors.New("'" + change.New.CN + "' is already an admin")
+		}
+		admins[i] = change.New
+		return admins, nil
+	}
+
+	return nil, errors.New("Unknown admin action '" + action + "'")
+}
+
+// adds, removes or rotates an admin, every change is written to the admin audit trail
+func (t *LoyaltyChaincode) changeAdmins(stub shim.ChaincodeStubInterface, args []string, action string) pb.Response {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	// only admins are able to change the admins
+	if !settings.isAdmin(caller) {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	if len(args) != 1 {
+		return shim.Error(action + "Admin expected 1 argument")
+	}
+
+	change := AdminChange{}
+	if action == "rotate" {
+		err = json.Unmarshal([]byte(args[0]), &change)
+	} else {
+		err = json.Unmarshal([]byte(args[0]), &change.Admin)
+	}
+	if err != nil {
+		return shim.Error("Error parsing admin json")
+	}
+
+	callerAdmin := AdminIdentity{}
+	callerAdmin.MspId, callerAdmin.CN = SplitIdentity(caller)
+
+	admins, err := updateAdmins(settings.Admins, action, change)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	settings.Admins = admins
+
+	err = t.putSettings(stub, settings)
+	if err != nil {
+		return shim.Error("Error saving settings: " + err.Error())
+	}
+
+	entry := AdminAuditEntry{Action: action, Admin: change.Admin}
+	if action == "rotate" {
+		entry.New = &change.New
+	}
+
+	data, err := t.auditAdminChanges(stub, callerAdmin, []AdminAuditEntry{entry})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stub.SetEvent("AdminChange", data)
+
+	result, _ := json.Marshal(settings.Admins)
+	return shim.Success(result)
+}
+
+// writes the changes of a transaction to the admin audit trail, keyed by transaction id and position
+func (t *LoyaltyChaincode) auditAdminChanges(stub shim.ChaincodeStubInterface, by AdminIdentity, entries []AdminAuditEntry) ([]byte, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		entries[i].TxId = stub.GetTxID()
+		entries[i].Timestamp = now
+		entries[i].By = by
+
+		data, _ := json.Marshal(entries[i])
+		key, _ := stub.CreateCompositeKey(IndexAdminAudit, []string{entries[i].TxId, strconv.Itoa(i)})
+		err = stub.PutState(key, data)
+		if err != nil {
+			return nil, errors.New("Error saving admin audit: " + err.Error())
+		}
+	}
+
+	data, _ := json.Marshal(entries[len(entries) - 1])
+	return data, nil
+}
+
+// adds or removes an auditor, every change is written to the admin audit trail
+func (t *LoyaltyChaincode) changeAuditors(stub shim.ChaincodeStubInterface, args []string, action string) pb.Response {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	// only admins are able to change the auditors
+	if !settings.isAdmin(caller) {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	if len(args) != 1 {
+		return shim.Error(action + " expected 1 argument")
+	}
+
+	auditor := AdminIdentity{}
+	err = json.Unmarshal([]byte(args[0]), &auditor)
+	if err != nil {
+		return shim.Error("Error parsing auditor json")
+	}
+
+	err = validIdentities([]AdminIdentity{auditor})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	i := indexOfAdmin(settings.Auditors, auditor)
+	switch action {
+	case "addAuditor":
+		if i >= 0 {
+			return shim.Error("'" + auditor.CN + "' is already an auditor")
+		}
+		settings.Auditors = append(settings.Auditors, auditor)
+	case "removeAuditor":
+		if i < 0 {
+			return shim.Error("'" + auditor.CN + "' is not an auditor")
+		}
+		settings.Auditors = append(settings.Auditors[:i], settings.Auditors[i+1:]...)
+	}
+
+	err = t.putSettings(stub, settings)
+	if err != nil {
+		return shim.Error("Error saving settings: " + err.Error())
+	}
+
+	callerAdmin := AdminIdentity{}
+	callerAdmin.MspId, callerAdmin.CN = SplitIdentity(caller)
+	data, err := t.auditAdminChanges(stub, callerAdmin, []AdminAuditEntry{{Action: action, Admin: auditor}})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stub.SetEvent("AdminChange", data)
+
+	result, _ := json.Marshal(settings.Auditors)
+	return shim.Success(result)
+}
+
+func (t *LoyaltyChaincode) getAdminAudit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if !settings.isAdmin(caller) {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexAdminAudit, []string{})
+	if err != nil {
+		return shim.Error("Could not build audit iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	var result []AdminAuditEntry = []AdminAuditEntry{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		entry := AdminAuditEntry{}
+		err = json.Unmarshal(kv.Value, &entry)
+		if err != nil {
+			return shim.Error("audit entry parsing error: " + err.Error())
+		}
+
+		result = append(result, entry)
+	}
+
+	// keys are transaction ids, the trail is returned in time order
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Timestamp < result[j].Timestamp
+	})
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	return shim.Success(resultJson)
+}
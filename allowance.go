@@ -3,9 +3,36 @@ package main
 import (
 	"encoding/json"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
 	"errors"
 )
 
+// a deadline of 0 means the allowance never expires, like assets it is expired from the deadline second on
+func (a *Allowance) expired(now int64) bool {
+	return a.Deadline != 0 && a.Deadline <= now
+}
+
+// deadline of a new allowance, the requested one or the default of the settings
+func (t *LoyaltyChaincode) allowanceDeadline(stub shim.ChaincodeStubInterface, requested int64, now int64) (int64, error) {
+	if requested != 0 {
+		if requested <= now {
+			return 0, errors.New("Bad request: deadline is in the past")
+		}
+		return requested, nil
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return 0, err
+	}
+
+	if settings.AllowanceDays == 0 {
+		return 0, nil
+	}
+
+	return now + int64(settings.AllowanceDays) * secondsPerDay, nil
+}
+
 func (t *LoyaltyChaincode) getAllowance(stub shim.ChaincodeStubInterface, prefix string, cn1 string, cn2 string) (*Allowance, error) {
 
 	key, _ := stub.CreateCompositeKey(prefix, []string{cn1, cn2})
@@ -25,29 +52,24 @@ func (t *LoyaltyChaincode) getAllowance(stub shim.ChaincodeStubInterface, prefix
 	return &allowance, nil
 }
 
-func (t *LoyaltyChaincode) updateAllowance(stub shim.ChaincodeStubInterface, prefix string, cn1 string, cn2 string, delta uint64, negSign bool) (*Allowance, error) {
+// the deadline only applies to increases, the later deadline of the old and the new part wins
+func (t *LoyaltyChaincode) updateAllowance(stub shim.ChaincodeStubInterface, prefix string, cn1 string, cn2 string, delta uint64, negSign bool, deadline int64) (*Allowance, error) {
 
 	allowance, _ := t.getAllowance(stub, prefix, cn1, cn2)
 
-	if allowance != nil {
-		if negSign {
-			if allowance.Value - delta > allowance.Value {
-				return nil, errors.New("value of allowance is to small to proceed transaction")
-			}
-			allowance.Value = allowance.Value - delta
-		} else {
-			allowance.Value += delta
-		}
-	} else {
-		if negSign {
-			return nil, errors.New("value of allowance is to small to proceed transaction")
-		} else {
-			allowance = &Allowance{
-				Buyer: cn2,
-				Value: delta,
-			}
-		}
+	if allowance == nil {
+		allowance = &Allowance{Buyer: cn2}
+	}
+
+	value, err := changeAmount(allowance.Value, delta, negSign)
+	if err != nil {
+		return nil, errors.New("value of allowance: " + err.Error())
+	}
+
+	if !negSign && (allowance.Value == 0 || deadline == 0 || (allowance.Deadline != 0 && allowance.Deadline < deadline)) {
+		allowance.Deadline = deadline
 	}
+	allowance.Value = value
 
 	key, _ := stub.CreateCompositeKey(prefix, []string{cn1, cn2})
 
@@ -62,4 +84,106 @@ func (t *LoyaltyChaincode) updateAllowance(stub shim.ChaincodeStubInterface, pre
 	}
 
 	return allowance, nil
+}
+
+// gives the unwithdrawn value of all expired allowances back to the customers,
+// the admin releases the allowances of all customers, a customer only its own
+func (t *LoyaltyChaincode) releaseExpiredAllowances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	filter := []string{}
+	if !settings.isAdmin(caller) {
+		if !t.userExists(stub, caller, "customer") {
+			return shim.Error("I don't know you, " + caller + "!")
+		}
+		filter = []string{caller}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomerAllowances, filter)
+	if err != nil {
+		return shim.Error("Could not build allowance iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	var result []AllowanceEvent = []AllowanceEvent{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		allowance := Allowance{}
+		err = json.Unmarshal(kv.Value, &allowance)
+		if err != nil {
+			return shim.Error("allowance parsing error: " + err.Error())
+		}
+
+		if allowance.Value == 0 || !allowance.expired(now) {
+			continue
+		}
+
+		_, parts, _ := stub.SplitCompositeKey(kv.Key)
+		result = append(result, AllowanceEvent{
+			Buyer: parts[0],
+			Shop: allowance.Buyer,
+			Value: allowance.Value,
+		})
+	}
+
+	// a transaction must write the balance of a customer only once
+	var buyers []string
+	released := map[string]uint64{}
+	shops := map[string]string{}
+	for _, release := range result {
+		if _, ok := released[release.Buyer]; !ok {
+			buyers = append(buyers, release.Buyer)
+			shops[release.Buyer] = release.Shop
+		} else if shops[release.Buyer] != release.Shop {
+			shops[release.Buyer] = ""
+		}
+		released[release.Buyer] += release.Value
+
+		_, err = t.updateAllowance(stub, IndexCustomerAllowances, release.Buyer, release.Shop, release.Value, true, 0)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, err = t.updateAllowance(stub, IndexShopAllowances, release.Shop, release.Buyer, release.Value, true, 0)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// the shop is the counterparty if only one allowance of the customer expired
+	for _, buyer := range buyers {
+		err = t.updateUserBalance(stub, IndexCustomer, buyer, released[buyer], false, Movement{Type: LedgerRelease, Counterparty: shops[buyer]})
+		if err != nil {
+			return shim.Error("Error restoring customer balance: " + err.Error())
+		}
+	}
+
+	err = t.releasePending(stub, released)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	evtData, _ := json.Marshal(result)
+	if len(result) > 0 {
+		stub.SetEvent("ReleaseAllowances", evtData)
+	}
+
+	return shim.Success(evtData)
 }
\ No newline at end of file
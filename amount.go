@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// a number of points, the arithmetic on it fails instead of wrapping around
+type Amount uint64
+
+var (
+	ErrZeroAmount      = errors.New("amount must be greater than 0")
+	ErrAmountOverflow  = errors.New("amount exceeds the maximum of " + uintToString(math.MaxUint64))
+	ErrAmountUnderflow = errors.New("amount is too small to proceed transaction")
+)
+
+// the amount of a request or booking, which must not be zero
+func NewAmount(value uint64) (Amount, error) {
+	if value == 0 {
+		return 0, ErrZeroAmount
+	}
+	return Amount(value), nil
+}
+
+func (a Amount) Add(delta Amount) (Amount, error) {
+	if delta > math.MaxUint64 - a {
+		return a, ErrAmountOverflow
+	}
+	return a + delta, nil
+}
+
+func (a Amount) Sub(delta Amount) (Amount, error) {
+	if delta > a {
+		return a, ErrAmountUnderflow
+	}
+	return a - delta, nil
+}
+
+// adds delta, or subtracts it with negSign
+func (a Amount) Change(delta Amount, negSign bool) (Amount, error) {
+	if negSign {
+		return a.Sub(delta)
+	}
+	return a.Add(delta)
+}
+
+// changes value by a delta which must not be zero
+func changeAmount(value uint64, delta uint64, negSign bool) (uint64, error) {
+	checked, err := NewAmount(delta)
+	if err != nil {
+		return value, err
+	}
+
+	result, err := Amount(value).Change(checked, negSign)
+	return uint64(result), err
+}
+
+// adds value to the sum, a sum which would overflow stays unchanged
+func addAmount(sum *uint64, value uint64) error {
+	result, err := Amount(*sum).Add(Amount(value))
+	*sum = uint64(result)
+	return err
+}
@@ -4,40 +4,127 @@ import (
 	"encoding/json"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"errors"
+	"strconv"
 )
 
 
+// an asset together with the key it is stored under
+type assetEntry struct {
+	Owner   string
+	Spender string
+	Id      string
+	Asset   Asset
+}
+
+// all assets of the owner in key order
+func (t *LoyaltyChaincode) listAssets(stub shim.ChaincodeStubInterface, prefix string, owner string) ([]assetEntry, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(prefix, []string{owner})
+	if err != nil {
+		return nil, errors.New("Could not build asset iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	var result []assetEntry
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, errors.New("Error splitting composite key" + err.Error())
+		}
+
+		asset := Asset{}
+		err = json.Unmarshal(kv.Value, &asset)
+		if err != nil {
+			return nil, errors.New("asset parsing error: " + err.Error())
+		}
+
+		result = append(result, assetEntry{
+			Owner: parts[0],
+			Spender: parts[1],
+			Id: parts[2],
+			Asset: asset,
+		})
+	}
+
+	return result, nil
+}
+
 func (t *LoyaltyChaincode) removeAsset(stub shim.ChaincodeStubInterface, prefix string, owner string, spender string, id string) error {
 	key, _ := stub.CreateCompositeKey(prefix, []string{owner, spender, id})
 	return stub.DelState(key)
 }
 
-func (t *LoyaltyChaincode) createAsset(stub shim.ChaincodeStubInterface, prefix string, owner string, spender string, history []string, value uint64) (*Asset, error) {
-	var id uint64 = uint64(0)
+// stores the asset under the next free id and returns the id
+func (t *LoyaltyChaincode) createAsset(stub shim.ChaincodeStubInterface, prefix string, owner string, spender string, asset Asset) (string, error) {
+	var id string
+	var err error
 
 	// check if key exists already
 	for {
-		id = uint64Random()
-		key, _ := stub.CreateCompositeKey(prefix, []string{owner, spender, uintToString(id)})
+		id, err = nextAssetId(stub)
+		if err != nil {
+			return "", err
+		}
+		key, _ := stub.CreateCompositeKey(prefix, []string{owner, spender, id})
 		res, err := stub.GetState(key)
 		if err != nil {
-			return nil, errors.New("Error trying to find an unused key: " + err.Error())
+			return "", errors.New("Error trying to find an unused key: " + err.Error())
 		} else if res == nil {
 			break
 		}
 	}
 
-	return t.storeAsset(stub, prefix, owner, spender, uintToString(id), history, value)
+	_, err = t.storeAsset(stub, prefix, owner, spender, id, asset)
+	return id, err
 }
 
-func (t *LoyaltyChaincode) storeAsset(stub shim.ChaincodeStubInterface, prefix string, owner string, spender string, id string, history []string, value uint64) (*Asset, error) {
+// hands a withdrawn asset to the shop and the claim on it to the issuing bank, the shop side keeps the id of the claim
+func (t *LoyaltyChaincode) createClaim(stub shim.ChaincodeStubInterface, shopCn string, userCn string, asset Asset, now int64) error {
+	asset.History = append(append([]string{}, asset.History...), userCn)
+	asset.ClaimedAt = now
 
+	claim := asset
+	claim.History = append(append([]string{}, asset.History...), shopCn)
+	id, err := t.createAsset(stub, IndexBankAsset, asset.History[0], shopCn, claim)
+	if err != nil {
+		return errors.New("Error creating Asset for '" + asset.History[0] + "':" + err.Error())
+	}
+
+	asset.Claim = id
+	_, err = t.createAsset(stub, IndexShopAsset, shopCn, userCn, asset)
+	if err != nil {
+		return errors.New("Error creating Asset for '" + shopCn + "':" + err.Error())
+	}
+	return nil
+}
 
-	asset := Asset{
-		Value: value,
-		History: history,
+// builds the next asset id of the running transaction: "<txId>-<counter>"
+func nextAssetId(stub shim.ChaincodeStubInterface) (string, error) {
+	tx, ok := stub.(*invocation)
+	if !ok {
+		return "", errors.New("assets can only be created by an invocation")
 	}
 
+	n := tx.assets
+	tx.assets++
+	return stub.GetTxID() + "-" + uintToString(n), nil
+}
+
+// asset ids created before the switch to transaction based ids are plain random numbers
+func isLegacyAssetId(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+func (t *LoyaltyChaincode) storeAsset(stub shim.ChaincodeStubInterface, prefix string, owner string, spender string, id string, asset Asset) (*Asset, error) {
+
+	// info is derived from the key history and never stored
+	asset.Info = InfoEntry{}
+
 	result, err := json.Marshal(asset)
 	if err != nil {
 		return nil, err
@@ -51,3 +138,129 @@ func (t *LoyaltyChaincode) storeAsset(stub shim.ChaincodeStubInterface, prefix s
 
 	return &asset, nil
 }
+
+// re-keys all assets of the index which still carry a legacy random id
+func (t *LoyaltyChaincode) migrateAssetIndex(stub shim.ChaincodeStubInterface, prefix string) (int, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(prefix, []string{})
+	if err != nil {
+		return 0, errors.New("Could not build asset iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	// collect first, the index must not change while we iterate over it
+	var legacyKeys []string
+	var legacyAssets []Asset
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return 0, errors.New("Error splitting composite key" + err.Error())
+		}
+
+		if !isLegacyAssetId(parts[2]) {
+			continue
+		}
+
+		asset := Asset{}
+		err = json.Unmarshal(kv.Value, &asset)
+		if err != nil {
+			return 0, errors.New("asset parsing error: " + err.Error())
+		}
+
+		legacyKeys = append(legacyKeys, kv.Key)
+		legacyAssets = append(legacyAssets, asset)
+	}
+
+	for i, key := range legacyKeys {
+		_, parts, _ := stub.SplitCompositeKey(key)
+		owner := parts[0]
+		spender := parts[1]
+
+		_, err = t.createAsset(stub, prefix, owner, spender, legacyAssets[i])
+		if err != nil {
+			return 0, errors.New("Error creating Asset for '" + owner + "':" + err.Error())
+		}
+
+		err = stub.DelState(key)
+		if err != nil {
+			return 0, errors.New("Error removing Asset '" + owner + "-" + spender + "-" + parts[2] + "':" + err.Error())
+		}
+	}
+
+	return len(legacyKeys), nil
+}
+
+// removes assets of the owner accepted by match until value is reached, splitting the last one if needed.
+// Returns the removed parts.
+func (t *LoyaltyChaincode) consumeAssets(stub shim.ChaincodeStubInterface, prefix string, owner string, value uint64, match func(assetEntry) bool) ([]assetEntry, error) {
+	assets, err := t.listAssets(stub, prefix, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []assetEntry
+	available := uint64(0)
+	for _, entry := range assets {
+		if match(entry) {
+			matching = append(matching, entry)
+			available += entry.Asset.Value
+		}
+	}
+
+	if available < value {
+		return nil, errors.New("Assets of '" + owner + "' do not cover the amount of " + uintToString(value))
+	}
+
+	restSum := value
+	var result []assetEntry
+	for _, entry := range matching {
+		if restSum == 0 {
+			break
+		}
+
+		asset := entry.Asset
+
+		if asset.Value <= restSum {
+			err = t.removeAsset(stub, prefix, owner, entry.Spender, entry.Id)
+			if err != nil {
+				return nil, errors.New("Error removing Asset '" + owner + "-" + entry.Spender + "-" + entry.Id + "':" + err.Error())
+			}
+			restSum -= asset.Value
+		} else {
+			rest := asset
+			rest.Value = asset.Value - restSum
+			_, err = t.storeAsset(stub, prefix, owner, entry.Spender, entry.Id, rest)
+			if err != nil {
+				return nil, errors.New("Error updating Asset '" + owner + "-" + entry.Spender + "-" + entry.Id + "':" + err.Error())
+			}
+			asset.Value = restSum
+			restSum = 0
+		}
+
+		entry.Asset = asset
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+
+// sums the values of the assets per customer that handed them on, the second to last history entry,
+// customers are returned in order of appearance
+func valuesPerCustomer(assets []assetEntry) ([]string, map[string]uint64) {
+	var customers []string
+	values := map[string]uint64{}
+	for _, entry := range assets {
+		history := entry.Asset.History
+		customer := history[len(history) - 2]
+		if _, ok := values[customer]; !ok {
+			customers = append(customers, customer)
+		}
+		values[customer] += entry.Asset.Value
+	}
+	return customers, values
+}
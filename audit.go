@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// reads the key parts and value of an entry as the actor and amount it adds to, an empty actor skips the entry
+type auditEntry func(parts []string, value []byte) (string, uint64, error)
+
+// sums the amounts of all entries of the index per actor
+func (t *LoyaltyChaincode) sumIndex(stub shim.ChaincodeStubInterface, prefix string, entry auditEntry) (map[string]uint64, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(prefix, []string{})
+	if err != nil {
+		return nil, errors.New("Could not build iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	result := map[string]uint64{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, errors.New("Error splitting composite key" + err.Error())
+		}
+
+		actor, amount, err := entry(parts, kv.Value)
+		if err != nil {
+			return nil, errors.New("Error reading '" + prefix + "': " + err.Error())
+		}
+		if actor != "" {
+			sum := result[actor]
+			err = addAmount(&sum, amount)
+			if err != nil {
+				return nil, errors.New("Error summing '" + prefix + "' of '" + actor + "': " + err.Error())
+			}
+			result[actor] = sum
+		}
+	}
+
+	return result, nil
+}
+
+func auditBalance(parts []string, value []byte) (string, uint64, error) {
+	if len(value) != 8 {
+		return "", 0, errors.New("balance of '" + parts[0] + "' is malformed")
+	}
+	return parts[0], binary.LittleEndian.Uint64(value), nil
+}
+
+func auditAssetOwner(parts []string, value []byte) (string, uint64, error) {
+	asset := Asset{}
+	err := json.Unmarshal(value, &asset)
+	return parts[0], asset.Value, err
+}
+
+func auditAssetIssuer(parts []string, value []byte) (string, uint64, error) {
+	asset := Asset{}
+	err := json.Unmarshal(value, &asset)
+	if err != nil || len(asset.History) == 0 {
+		return "", 0, err
+	}
+	return asset.History[0], asset.Value, nil
+}
+
+func auditAllowance(parts []string, value []byte) (string, uint64, error) {
+	allowance := Allowance{}
+	err := json.Unmarshal(value, &allowance)
+	return parts[0], allowance.Value, err
+}
+
+// points taken from the customers, burned claims were counted as claimed before
+func auditRetirement(parts []string, value []byte) (string, uint64, error) {
+	retirement := Retirement{}
+	err := json.Unmarshal(value, &retirement)
+	if err != nil || retirement.Kind == RetirementBurn {
+		return "", 0, err
+	}
+	return retirement.Bank, retirement.Value, nil
+}
+
+func sortedActors(sums ...map[string]uint64) []string {
+	seen := map[string]bool{}
+	var actors []string
+	for _, sum := range sums {
+		for actor := range sum {
+			if !seen[actor] {
+				seen[actor] = true
+				actors = append(actors, actor)
+			}
+		}
+	}
+	sort.Strings(actors)
+	return actors
+}
+
+// compares the balances with the assets and allowances they stand for, and the liability counters with the points
+// they count. Available to admins and auditors.
+func (t *LoyaltyChaincode) auditInvariants(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	if !settings.isAuditor(caller) {
+		return shim.Error("Only admins and auditors can audit the ledger")
+	}
+
+	sums := []struct {
+		prefix string
+		entry  auditEntry
+		result map[string]uint64
+	}{
+		{IndexCustomer, auditBalance, nil},
+		{IndexCustomerAsset, auditAssetOwner, nil},
+		{IndexCustomerAllowances, auditAllowance, nil},
+		{IndexCustomerAsset, auditAssetIssuer, nil},
+		{IndexBank, auditBalance, nil},
+		{IndexBankAsset, auditAssetOwner, nil},
+		{IndexBankExpired, auditAssetOwner, nil},
+		{IndexBankRetired, auditRetirement, nil},
+	}
+	for i := range sums {
+		sums[i].result, err = t.sumIndex(stub, sums[i].prefix, sums[i].entry)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	balances, assets, allowances, issuedAssets := sums[0].result, sums[1].result, sums[2].result, sums[3].result
+	bankBalances, claims, expired, retired := sums[4].result, sums[5].result, sums[6].result, sums[7].result
+
+	report := AuditReport{Discrepancies: []AuditDiscrepancy{}}
+	held := map[string]uint64{}
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexBankLiability, []string{})
+	if err != nil {
+		return shim.Error("Could not build liability iterator: " + err.Error())
+	}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return shim.Error(err.Error())
+		}
+
+		liability := BankLiability{}
+		err = json.Unmarshal(kv.Value, &liability)
+		if err != nil {
+			iterator.Close()
+			return shim.Error("Error parsing liability:" + err.Error())
+		}
+
+		_, parts, _ := stub.SplitCompositeKey(kv.Key)
+		held[parts[0]] = liability.held()
+		err = addAmount(&report.Issued, liability.Issued)
+		if err == nil {
+			err = addAmount(&report.Claimed, liability.Claimed)
+		}
+		if err != nil {
+			iterator.Close()
+			return shim.Error("Error summing liabilities: " + err.Error())
+		}
+	}
+	iterator.Close()
+
+	check := func(kind AuditCheck, actor string, expected uint64, actual uint64) {
+		if expected != actual {
+			report.Discrepancies = append(report.Discrepancies, AuditDiscrepancy{kind, actor, expected, actual})
+		}
+	}
+
+	// the points of redemptions stay with the customer until the shop withdraws them
+	customers := sortedActors(balances, assets, allowances)
+	for _, customer := range customers {
+		expected := balances[customer]
+		err = addAmount(&expected, allowances[customer])
+		if err != nil {
+			return shim.Error("Error summing the points of '" + customer + "': " + err.Error())
+		}
+		check(AuditCustomerBalance, customer, expected, assets[customer])
+	}
+
+	banks := sortedActors(bankBalances, claims)
+	for _, bank := range banks {
+		check(AuditBankClaims, bank, bankBalances[bank], claims[bank])
+	}
+
+	for _, bank := range sortedActors(held, issuedAssets) {
+		check(AuditBankHeld, bank, held[bank], issuedAssets[bank])
+	}
+
+	for _, sum := range []struct {
+		total  *uint64
+		values map[string]uint64
+	}{
+		{&report.Held, issuedAssets},
+		{&report.Retired, expired},
+		{&report.Retired, retired},
+	} {
+		for _, value := range sum.values {
+			err = addAmount(sum.total, value)
+			if err != nil {
+				return shim.Error("Error summing the supply: " + err.Error())
+			}
+		}
+	}
+	supply := report.Held
+	err = addAmount(&supply, report.Claimed)
+	if err == nil {
+		err = addAmount(&supply, report.Retired)
+	}
+	if err != nil {
+		return shim.Error("Error summing the supply: " + err.Error())
+	}
+	check(AuditSupply, "", report.Issued, supply)
+
+	report.Customers = len(customers)
+	report.Banks = len(banks)
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	return shim.Success(data)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+func (t *LoyaltyChaincode) putRetirement(stub shim.ChaincodeStubInterface, retirement *Retirement) ([]byte, error) {
+	data, err := json.Marshal(retirement)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexBankRetired, []string{retirement.Bank, retirement.Id})
+	return data, stub.PutState(key, data)
+}
+
+// lowers the amount the bank provided to the customer, points received by transfer aren't counted there
+func (t *LoyaltyChaincode) reduceBanksCustomer(stub shim.ChaincodeStubInterface, bankCn string, userCn string, value uint64) error {
+	key, _ := stub.CreateCompositeKey(IndexBanksCustomers, []string{bankCn, userCn})
+	data, err := stub.GetState(key)
+	if err != nil || data == nil {
+		return err
+	}
+
+	provided := binary.LittleEndian.Uint64(data)
+	if provided < value {
+		value = provided
+	}
+
+	data = make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, provided - value)
+	return stub.PutState(key, data)
+}
+
+// a bank takes back up to value of the unspent points it issued to a customer
+func (t *LoyaltyChaincode) clawback(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	bank, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if !t.userExists(stub, bank, "bank") {
+		return shim.Error("I don't know you, " + bank + "!")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("clawback expected 1 argument")
+	}
+
+	retirement := Retirement{}
+	err = json.Unmarshal([]byte(args[0]), &retirement)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	if retirement.Customer == "" || retirement.Value == 0 || retirement.Reason == "" {
+		return shim.Error("Bad request: customer, value and reason are required")
+	}
+
+	err = t.resolveActors(stub, &retirement.Customer)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	if !t.userExists(stub, retirement.Customer, "customer") {
+		return shim.Error("Bad request: customer doesn't exist")
+	}
+
+	issued := func(entry assetEntry) bool {
+		return entry.Asset.History[0] == bank
+	}
+
+	assets, err := t.listAssets(stub, IndexCustomerAsset, retirement.Customer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	available := uint64(0)
+	for _, entry := range assets {
+		if issued(entry) {
+			available += entry.Asset.Value
+		}
+	}
+
+	// points reserved by allowances are not part of the balance
+	balance, err := t.userBalance(stub, IndexCustomer, retirement.Customer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if available > balance {
+		available = balance
+	}
+	if retirement.Value > available {
+		retirement.Value = available
+	}
+	if retirement.Value == 0 {
+		return shim.Error("Customer '" + retirement.Customer + "' holds no unspent points of yours")
+	}
+
+	_, err = t.consumeAssets(stub, IndexCustomerAsset, retirement.Customer, retirement.Value, issued)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.updateUserBalance(stub, IndexCustomer, retirement.Customer, retirement.Value, true, Movement{LedgerClawback, bank, retirement.Reason})
+	if err != nil {
+		return shim.Error("Error updating customer balance: " + err.Error())
+	}
+
+	err = t.reduceBanksCustomer(stub, bank, retirement.Customer, retirement.Value)
+	if err != nil {
+		return shim.Error("Error updating bank customer: " + err.Error())
+	}
+
+	deltas := liabilityDeltas{}
+	deltas.of(bank).outstanding.down(retirement.Value)
+	err = t.movePendingOfRemoved(stub, retirement.Customer, assets, map[string]uint64{bank: retirement.Value}, deltas)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = t.changeLiabilities(stub, deltas)
+	if err != nil {
+		return shim.Error("Error updating liability: " + err.Error())
+	}
+
+	retirement.Id = stub.GetTxID()
+	retirement.Kind = RetirementClawback
+	retirement.Bank = bank
+	retirement.Shop = ""
+
+	data, err := t.putRetirement(stub, &retirement)
+	if err != nil {
+		return shim.Error("Error saving clawback: " + err.Error())
+	}
+
+	stub.SetEvent("Clawback", data)
+	return shim.Success(data)
+}
+
+// a bank retires claims of a shop it holds, together with the shop side of the claims
+func (t *LoyaltyChaincode) burn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	bank, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if !t.userExists(stub, bank, "bank") {
+		return shim.Error("I don't know you, " + bank + "!")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("burn expected 1 argument")
+	}
+
+	retirement := Retirement{}
+	err = json.Unmarshal([]byte(args[0]), &retirement)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	if retirement.Shop == "" || retirement.Value == 0 || retirement.Reason == "" {
+		return shim.Error("Bad request: shop, value and reason are required")
+	}
+
+	err = t.resolveActors(stub, &retirement.Shop)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	if !t.userExists(stub, retirement.Shop, "shop") {
+		return shim.Error("Bad request: shop doesn't exist")
+	}
+
+	// claims which are being settled can't be burned
+	batched, err := t.batchedClaims(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	claims, err := t.consumeAssets(stub, IndexBankAsset, bank, retirement.Value, func(entry assetEntry) bool {
+		return entry.Spender == retirement.Shop && !batched[batchedClaimKey(bank, entry.Id)]
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the shop side of exactly these claims, the ones of a batch stay with the shop
+	err = t.consumeShopSide(stub, retirement.Shop, bank, claims)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.updateUserBalance(stub, IndexBank, bank, retirement.Value, true, Movement{LedgerBurn, retirement.Shop, retirement.Reason})
+	if err != nil {
+		return shim.Error("Error updating bank balance: " + err.Error())
+	}
+
+	err = t.updateUserBalance(stub, IndexShop, retirement.Shop, retirement.Value, true, Movement{LedgerBurn, bank, retirement.Reason})
+	if err != nil {
+		return shim.Error("Error updating shop balance: " + err.Error())
+	}
+
+	retirement.Id = stub.GetTxID()
+	retirement.Kind = RetirementBurn
+	retirement.Bank = bank
+	retirement.Customer = ""
+
+	data, err := t.putRetirement(stub, &retirement)
+	if err != nil {
+		return shim.Error("Error saving burn: " + err.Error())
+	}
+
+	stub.SetEvent("Burn", data)
+	return shim.Success(data)
+}
+
+func (t *LoyaltyChaincode) getRetirements(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	bank, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if !t.userExists(stub, bank, "bank") {
+		return shim.Error("I don't know you, " + bank + "!")
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexBankRetired, []string{bank})
+	if err != nil {
+		return shim.Error("Could not build retirement iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	var result []*Retirement = []*Retirement{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		retirement := Retirement{}
+		err = json.Unmarshal(kv.Value, &retirement)
+		if err != nil {
+			return shim.Error("retirement parsing error: " + err.Error())
+		}
+
+		result = append(result, &retirement)
+	}
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	return shim.Success(resultJson)
+}
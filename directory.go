@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// the roles in the order they are listed, with their balance index
+var directoryRoles = []struct {
+	role   string
+	prefix string
+}{
+	{"bank", IndexBank},
+	{"shop", IndexShop},
+	{"customer", IndexCustomer},
+}
+
+// the roles the caller may list, customers are only visible to the admin
+func (t *LoyaltyChaincode) visibleRoles(stub shim.ChaincodeStubInterface, caller string) (map[string]bool, error) {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return nil, errors.New("Error getting settings")
+	}
+
+	if settings.isAdmin(caller) {
+		return map[string]bool{"bank": true, "shop": true, "customer": true}, nil
+	}
+
+	for _, role := range directoryRoles {
+		if t.userExists(stub, caller, role.role) {
+			return map[string]bool{"bank": true, "shop": true}, nil
+		}
+	}
+
+	return nil, errors.New("I don't know you, " + caller + "!")
+}
+
+// lists actors of the visible roles role by role, the bookmark is the role to continue with and its page bookmark
+func (t *LoyaltyChaincode) listDirectory(stub shim.ChaincodeStubInterface, query ActorQuery, visible map[string]bool) (*ActorPage, error) {
+	page := ActorPage{Records: []DirectoryEntry{}}
+
+	if query.Role != "" {
+		if !validRole(query.Role) {
+			return nil, errors.New("Unknown role '" + query.Role + "'")
+		}
+		if !visible[query.Role] {
+			return nil, errors.New("You are not allowed to list the role '" + query.Role + "'")
+		}
+	}
+
+	bookmarkRole, bookmark := "", ""
+	if query.Bookmark != "" {
+		parts := strings.SplitN(query.Bookmark, ":", 2)
+		if len(parts) != 2 || !validRole(parts[0]) {
+			return nil, errors.New("Bad bookmark '" + query.Bookmark + "'")
+		}
+		bookmarkRole, bookmark = parts[0], parts[1]
+	}
+
+	// closed and offboarded actors aren't listed, other entries carry the status of the actor
+	entryOf := func(key string, role string) (*DirectoryEntry, error) {
+		_, parts, err := stub.SplitCompositeKey(key)
+		if err != nil {
+			return nil, errors.New("Error splitting composite key" + err.Error())
+		}
+
+		actor, err := t.getActor(stub, parts[0])
+		if err != nil {
+			return nil, err
+		} else if actor.Status == ActorClosed {
+			return nil, nil
+		}
+
+		entry := DirectoryEntry{Id: parts[0], Role: role, Status: actor.Status}
+		if query.Metadata {
+			entry.Metadata = actor.Metadata
+			entry.Profile, err = t.getProfile(stub, entry.Id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &entry, nil
+	}
+
+	reached := bookmarkRole == ""
+	for _, role := range directoryRoles {
+		if role.role == bookmarkRole {
+			reached = true
+		}
+		if !reached || !visible[role.role] || (query.Role != "" && query.Role != role.role) {
+			continue
+		}
+
+		// a full page continues with this role if it has any listed actor
+		if int32(len(page.Records)) == query.PageSize {
+			found := false
+			_, err := t.visitPage(stub, role.prefix, []string{}, PageQuery{PageSize: 1}, func(key string, value []byte) (bool, error) {
+				entry, err := entryOf(key, role.role)
+				found = entry != nil
+				return found, err
+			})
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				page.Bookmark = role.role + ":"
+				return &page, nil
+			}
+			continue
+		}
+
+		rolePage := PageQuery{PageSize: query.PageSize - int32(len(page.Records)), Bookmark: bookmark}
+		bookmark = ""
+		next, err := t.visitPage(stub, role.prefix, []string{}, rolePage, func(key string, value []byte) (bool, error) {
+			entry, err := entryOf(key, role.role)
+			if err != nil || entry == nil {
+				return false, err
+			}
+
+			page.Records = append(page.Records, *entry)
+			page.Count = len(page.Records)
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if next != "" {
+			page.Bookmark = role.role + ":" + next
+			return &page, nil
+		}
+	}
+
+	return &page, nil
+}
+
+// lists the actors the caller may see, args: {role, pageSize, bookmark, metadata}
+func (t *LoyaltyChaincode) listActors(stub shim.ChaincodeStubInterface, args []string, role string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	query := ActorQuery{}
+	if len(args) == 1 && args[0] != "" {
+		err = json.Unmarshal([]byte(args[0]), &query)
+		if err != nil {
+			return shim.Error("Error parsing arguments")
+		}
+	}
+
+	err = query.applyLimits()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if role != "" {
+		query.Role = role
+	}
+
+	visible, err := t.visibleRoles(stub, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	page, err := t.listDirectory(stub, query, visible)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultJson, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	return shim.Success(resultJson)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const secondsPerDay = 24 * 60 * 60
+
+// an expiry of 0 means the asset never expires
+func (a *Asset) expired(now int64) bool {
+	return a.Expiry != 0 && a.Expiry <= now
+}
+
+// calculates the expiry of points issued now by the bank, the bank policy wins over the settings
+func (t *LoyaltyChaincode) pointsExpiry(stub shim.ChaincodeStubInterface, bankCn string) (int64, error) {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return 0, err
+	}
+	validityDays := settings.ValidityDays
+
+	key, _ := stub.CreateCompositeKey(IndexBankExpiryPolicy, []string{bankCn})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return 0, err
+	} else if data != nil {
+		policy := ExpiryPolicy{}
+		err = json.Unmarshal(data, &policy)
+		if err != nil {
+			return 0, errors.New("Error parsing expiry policy: " + err.Error())
+		}
+		validityDays = policy.ValidityDays
+	}
+
+	if validityDays == 0 {
+		return 0, nil
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return 0, err
+	}
+
+	return now + int64(validityDays) * secondsPerDay, nil
+}
+
+// the part of the customer balance which is covered by unexpired and not frozen assets
+func (t *LoyaltyChaincode) spendableBalance(stub shim.ChaincodeStubInterface, customerCn string, now int64) (uint64, error) {
+	balance, err := t.userBalance(stub, IndexCustomer, customerCn)
+	if err != nil {
+		return 0, err
+	}
+
+	assets, err := t.listAssets(stub, IndexCustomerAsset, customerCn)
+	if err != nil {
+		return 0, err
+	}
+
+	unexpired := uint64(0)
+	for _, entry := range assets {
+		if !entry.Asset.expired(now) && !entry.Asset.Frozen {
+			unexpired += entry.Asset.Value
+		}
+	}
+
+	if unexpired < balance {
+		return unexpired, nil
+	}
+	return balance, nil
+}
+
+// moves the expired assets of a customer back to the issuing bank, restricted to bankCn if given.
+// Assets reserved by open allowances are not part of the balance and stay with the customer.
+func (t *LoyaltyChaincode) expireCustomerPoints(stub shim.ChaincodeStubInterface, customerCn string, bankCn string, now int64, deltas liabilityDeltas) ([]ExpiryEvent, error) {
+	balance, err := t.userBalance(stub, IndexCustomer, customerCn)
+	if err != nil {
+		return nil, err
+	}
+
+	assets, err := t.listAssets(stub, IndexCustomerAsset, customerCn)
+	if err != nil {
+		return nil, err
+	}
+
+	budget := balance
+	var banks []string
+	perBank := map[string]uint64{}
+	for _, entry := range assets {
+		if budget == 0 {
+			break
+		}
+
+		asset := entry.Asset
+		if !asset.expired(now) || asset.Frozen || (bankCn != "" && asset.History[0] != bankCn) {
+			continue
+		}
+
+		sourceCn := entry.Spender
+		id := entry.Id
+
+		value := asset.Value
+		if value > budget {
+			value = budget
+		}
+
+		if value < asset.Value {
+			rest := asset
+			rest.Value = asset.Value - value
+			_, err = t.storeAsset(stub, IndexCustomerAsset, customerCn, sourceCn, id, rest)
+			if err != nil {
+				return nil, errors.New("Error updating Asset '" + customerCn + "-" + sourceCn + "-" + id + "':" + err.Error())
+			}
+		} else {
+			err = t.removeAsset(stub, IndexCustomerAsset, customerCn, sourceCn, id)
+			if err != nil {
+				return nil, errors.New("Error removing Asset '" + customerCn + "-" + sourceCn + "-" + id + "':" + err.Error())
+			}
+		}
+
+		// move asset back to the issuing bank
+		bank := asset.History[0]
+		asset.History = append(asset.History, customerCn)
+		asset.Value = value
+		_, err = t.createAsset(stub, IndexBankExpired, bank, customerCn, asset)
+		if err != nil {
+			return nil, errors.New("Error creating Asset for '" + bank + "':" + err.Error())
+		}
+
+		if _, ok := perBank[bank]; !ok {
+			banks = append(banks, bank)
+		}
+		perBank[bank] += value
+		budget -= value
+	}
+
+	if balance - budget > 0 {
+		err = t.updateUserBalance(stub, IndexCustomer, customerCn, balance - budget, true, Movement{Type: LedgerExpire})
+		if err != nil {
+			return nil, errors.New("Error updating customer balance: " + err.Error())
+		}
+	}
+
+	err = t.movePendingOfRemoved(stub, customerCn, assets, perBank, deltas)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []ExpiryEvent
+	for _, bank := range banks {
+		deltas.of(bank).outstanding.down(perBank[bank])
+		events = append(events, ExpiryEvent{
+			Customer: customerCn,
+			Bank: bank,
+			Value: perBank[bank],
+		})
+	}
+
+	return events, nil
+}
+
+func (t *LoyaltyChaincode) setExpiryPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	bank, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if !t.userExists(stub, bank, "bank") {
+		return shim.Error("I don't know you, " + bank + "!")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("setExpiryPolicy expected 1 argument")
+	}
+
+	policy := ExpiryPolicy{}
+	err = json.Unmarshal([]byte(args[0]), &policy)
+	if err != nil {
+		return shim.Error("Error parsing expiry policy json")
+	}
+
+	data, _ := json.Marshal(policy)
+	key, _ := stub.CreateCompositeKey(IndexBankExpiryPolicy, []string{bank})
+	err = stub.PutState(key, data)
+	if err != nil {
+		return shim.Error("Error saving expiry policy: " + err.Error())
+	}
+
+	return shim.Success(data)
+}
+
+// sweeps expired points of all customers, the admin sweeps the points of all banks, a bank only its own
+func (t *LoyaltyChaincode) expirePoints(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	bankCn := ""
+	if !settings.isAdmin(caller) {
+		if !t.userExists(stub, caller, "bank") {
+			return shim.Error("I don't know you, " + caller + "!")
+		}
+		bankCn = caller
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomer, []string{})
+	if err != nil {
+		return shim.Error("Could not build customer iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	var customers []string
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, parts, _ := stub.SplitCompositeKey(kv.Key)
+		customers = append(customers, parts[0])
+	}
+
+	// fabric keeps only one event per transaction, so all expiries are sent together
+	result := ExpirySweep{Customers: []string{}, Expiries: []ExpiryEvent{}}
+	deltas := liabilityDeltas{}
+	for _, customer := range customers {
+		events, err := t.expireCustomerPoints(stub, customer, bankCn, now, deltas)
+		if err != nil {
+			return shim.Error("Error expiring points of '" + customer + "': " + err.Error())
+		}
+		if len(events) > 0 {
+			result.Customers = append(result.Customers, customer)
+			result.Expiries = append(result.Expiries, events...)
+		}
+	}
+
+	err = t.changeLiabilities(stub, deltas)
+	if err != nil {
+		return shim.Error("Error updating liability: " + err.Error())
+	}
+
+	evtData, _ := json.Marshal(result)
+	if len(result.Customers) > 0 {
+		stub.SetEvent("Expire", evtData)
+	}
+
+	return shim.Success(evtData)
+}
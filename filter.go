@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// the page and filters of a list query, no argument gets the first page of the default size
+func (t *LoyaltyChaincode) parseListQuery(stub shim.ChaincodeStubInterface, args []string) (ListQuery, error) {
+	query := ListQuery{}
+	if len(args) == 1 && args[0] != "" {
+		err := json.Unmarshal([]byte(args[0]), &query)
+		if err != nil {
+			return query, errors.New("Error parsing arguments")
+		}
+	}
+
+	err := query.applyLimits()
+	if err != nil {
+		return query, err
+	}
+	if query.To != 0 && query.To < query.From {
+		return query, errors.New("Bad request: to is before from")
+	}
+
+	switch query.Sort {
+	case SortKeyOrder, SortOldest, SortNewest, SortSmallest, SortLargest:
+	default:
+		return query, errors.New("Unknown sort order '" + string(query.Sort) + "'")
+	}
+
+	err = t.resolveActors(stub, &query.Counterparty, &query.Bank)
+	if err != nil {
+		return query, errors.New("Bad request: " + err.Error())
+	}
+
+	return query, nil
+}
+
+// the partial key of the owner's entries, narrowed to the counterparty if the query names one
+func (q *ListQuery) keys(owner string) []string {
+	if q.Counterparty != "" {
+		return []string{owner, q.Counterparty}
+	}
+	return []string{owner}
+}
+
+// from and to are inclusive
+func (q *ListQuery) inRange(timestamp int64) bool {
+	return timestamp >= q.From && (q.To == 0 || timestamp <= q.To)
+}
+
+func (q *ListQuery) filterHistory(history []HistoryEntry) []HistoryEntry {
+	if q.From == 0 && q.To == 0 {
+		return history
+	}
+
+	var result []HistoryEntry = []HistoryEntry{}
+	for _, entry := range history {
+		if q.inRange(entry.Timestamp) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// a page is only sorted if it holds every matching record, later pages would restart the order. A peer may return a
+// bookmark after the last match, so the entries after it are probed with visit for one more match
+func (t *LoyaltyChaincode) sortable(stub shim.ChaincodeStubInterface, q ListQuery, objectType string, keys []string, bookmark string, visit func(key string, value []byte) (bool, error)) error {
+	if q.Sort == SortKeyOrder {
+		return nil
+	}
+	if q.Bookmark == "" && bookmark == "" {
+		return nil
+	}
+
+	more := false
+	if q.Bookmark == "" {
+		_, err := t.visitPage(stub, objectType, keys, PageQuery{PageSize: 1, Bookmark: bookmark}, func(key string, value []byte) (bool, error) {
+			ok, err := visit(key, value)
+			more = ok
+			return ok, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if q.Bookmark != "" || more {
+		return errors.New("Bad request: sort needs all matching records on one page, raise pageSize or narrow the filters")
+	}
+	return nil
+}
+
+// orders the records of a page, ties keep the key order
+func sortRecords(records interface{}, order SortOrder, timestamp func(i int) int64, value func(i int) uint64) {
+	var less func(i, j int) bool
+
+	switch order {
+	case SortOldest:
+		less = func(i, j int) bool {
+			return timestamp(i) < timestamp(j)
+		}
+	case SortNewest:
+		less = func(i, j int) bool {
+			return timestamp(i) > timestamp(j)
+		}
+	case SortSmallest:
+		less = func(i, j int) bool {
+			return value(i) < value(j)
+		}
+	case SortLargest:
+		less = func(i, j int) bool {
+			return value(i) > value(j)
+		}
+	default:
+		return
+	}
+
+	sort.SliceStable(records, less)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// registers the identity under its CN, so CN-only arguments can be resolved
+func (t *LoyaltyChaincode) putIdentity(stub shim.ChaincodeStubInterface, id string) error {
+	mspId, cn := SplitIdentity(id)
+	if mspId == "" {
+		return nil
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexIdentity, []string{cn, mspId})
+	return stub.PutState(key, []byte{0x00})
+}
+
+// resolves an actor argument to its identity, a bare CN is accepted when only one MSP knows it.
+// Names of a not yet migrated ledger are returned unchanged.
+func (t *LoyaltyChaincode) resolveActor(stub shim.ChaincodeStubInterface, name string) (string, error) {
+	if name == "" || !isLegacyIdentity(name) {
+		return name, nil
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexIdentity, []string{name})
+	if err != nil {
+		return "", errors.New("Could not build identity iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	var ids []string
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return "", err
+		}
+
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return "", errors.New("Error splitting composite key" + err.Error())
+		}
+		ids = append(ids, IdentityOf(parts[1], parts[0]))
+	}
+
+	switch len(ids) {
+	case 0:
+		return name, nil
+	case 1:
+		return ids[0], nil
+	}
+
+	msg := "'" + name + "' is ambiguous, use one of"
+	for _, id := range ids {
+		msg += " '" + id + "'"
+	}
+	return "", errors.New(msg)
+}
+
+// resolves several actor arguments in place
+func (t *LoyaltyChaincode) resolveActors(stub shim.ChaincodeStubInterface, names ...*string) error {
+	for _, name := range names {
+		id, err := t.resolveActor(stub, *name)
+		if err != nil {
+			return err
+		}
+		*name = id
+	}
+	return nil
+}
+
+// the identity of a legacy CN-only name, names which are already identities are kept
+func (m *IdentityMigration) identity(name string) string {
+	if name == "" || !isLegacyIdentity(name) {
+		return name
+	}
+	if mspId, ok := m.MspIds[name]; ok {
+		return IdentityOf(mspId, name)
+	}
+	return IdentityOf(m.DefaultMspId, name)
+}
+
+// rewrites the names of a stored value, returns the value unchanged when it holds none
+type valueRewrite func(value []byte, m *IdentityMigration) ([]byte, error)
+
+func rewriteRaw(value []byte, m *IdentityMigration) ([]byte, error) {
+	return value, nil
+}
+
+func rewriteAsset(value []byte, m *IdentityMigration) ([]byte, error) {
+	asset := Asset{}
+	err := json.Unmarshal(value, &asset)
+	if err != nil {
+		return nil, errors.New("asset parsing error: " + err.Error())
+	}
+	for i := range asset.History {
+		asset.History[i] = m.identity(asset.History[i])
+	}
+	return json.Marshal(asset)
+}
+
+func rewriteAllowance(value []byte, m *IdentityMigration) ([]byte, error) {
+	allowance := Allowance{}
+	err := json.Unmarshal(value, &allowance)
+	if err != nil {
+		return nil, errors.New("allowance parsing error: " + err.Error())
+	}
+	allowance.Buyer = m.identity(allowance.Buyer)
+	return json.Marshal(allowance)
+}
+
+func rewriteSettlement(value []byte, m *IdentityMigration) ([]byte, error) {
+	settlement := Settlement{}
+	err := json.Unmarshal(value, &settlement)
+	if err != nil {
+		return nil, errors.New("settlement parsing error: " + err.Error())
+	}
+	settlement.Bank = m.identity(settlement.Bank)
+	settlement.Shop = m.identity(settlement.Shop)
+	return json.Marshal(settlement)
+}
+
+func rewriteNettingReport(value []byte, m *IdentityMigration) ([]byte, error) {
+	report := NettingReport{}
+	err := json.Unmarshal(value, &report)
+	if err != nil {
+		return nil, errors.New("netting report parsing error: " + err.Error())
+	}
+	for _, obligations := range [][]NettingObligation{report.Gross, report.Net} {
+		for i := range obligations {
+			obligations[i].Payer = m.identity(obligations[i].Payer)
+			obligations[i].Payee = m.identity(obligations[i].Payee)
+		}
+	}
+	for i := range report.Positions {
+		report.Positions[i].Participant = m.identity(report.Positions[i].Participant)
+	}
+	return json.Marshal(report)
+}
+
+func rewriteRetirement(value []byte, m *IdentityMigration) ([]byte, error) {
+	retirement := Retirement{}
+	err := json.Unmarshal(value, &retirement)
+	if err != nil {
+		return nil, errors.New("retirement parsing error: " + err.Error())
+	}
+	retirement.Bank = m.identity(retirement.Bank)
+	retirement.Customer = m.identity(retirement.Customer)
+	retirement.Shop = m.identity(retirement.Shop)
+	return json.Marshal(retirement)
+}
+
+// an index holding names, the first names attributes of its keys are actors
+type identityIndex struct {
+	prefix  string
+	names   int
+	rewrite valueRewrite
+	actors  bool
+}
+
+var identityIndexes = []identityIndex{
+	{IndexCustomer, 1, rewriteRaw, true},
+	{IndexBank, 1, rewriteRaw, true},
+	{IndexShop, 1, rewriteRaw, true},
+	{IndexCustomerAsset, 2, rewriteAsset, false},
+	{IndexShopAsset, 2, rewriteAsset, false},
+	{IndexBankAsset, 2, rewriteAsset, false},
+	{IndexBankExpired, 2, rewriteAsset, false},
+	{IndexBanksCustomers, 2, rewriteRaw, false},
+	{IndexCustomerAllowances, 2, rewriteAllowance, false},
+	{IndexShopAllowances, 2, rewriteAllowance, false},
+	{IndexBankExpiryPolicy, 1, rewriteRaw, false},
+	{IndexSettlement, 0, rewriteSettlement, false},
+	{IndexNettingReport, 0, rewriteNettingReport, false},
+	{IndexBankRetired, 1, rewriteRetirement, false},
+}
+
+// re-keys all entries of the index which still carry CN-only names
+func (t *LoyaltyChaincode) migrateIdentityIndex(stub shim.ChaincodeStubInterface, index identityIndex, m *IdentityMigration) (int, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(index.prefix, []string{})
+	if err != nil {
+		return 0, errors.New("Could not build iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	// collect first, the index must not change while we iterate over it
+	var oldKeys []string
+	var newKeys []string
+	var values [][]byte
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return 0, errors.New("Error splitting composite key" + err.Error())
+		}
+
+		for i := 0; i < index.names && i < len(parts); i++ {
+			parts[i] = m.identity(parts[i])
+		}
+		key, _ := stub.CreateCompositeKey(index.prefix, parts)
+
+		value, err := index.rewrite(kv.Value, m)
+		if err != nil {
+			return 0, err
+		}
+
+		if key == kv.Key && bytes.Equal(value, kv.Value) {
+			continue
+		}
+
+		oldKeys = append(oldKeys, kv.Key)
+		newKeys = append(newKeys, key)
+		values = append(values, value)
+	}
+
+	for i, key := range oldKeys {
+		if newKeys[i] != key {
+			err = stub.DelState(key)
+			if err != nil {
+				return 0, errors.New("Error removing '" + key + "':" + err.Error())
+			}
+		}
+
+		err = stub.PutState(newKeys[i], values[i])
+		if err != nil {
+			return 0, errors.New("Error storing '" + newKeys[i] + "':" + err.Error())
+		}
+
+		if index.actors {
+			_, parts, _ := stub.SplitCompositeKey(newKeys[i])
+			err = t.putIdentity(stub, parts[0])
+			if err != nil {
+				return 0, errors.New("Error registering identity '" + parts[0] + "':" + err.Error())
+			}
+		}
+	}
+
+	return len(oldKeys), nil
+}
+
+// rewrites all keys and values of the ledger from CN-only names to MSP ID + CN identities
+func (t *LoyaltyChaincode) migrateIdentities(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("migrateIdentities expected 1 argument")
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	// only admin is able to migrate the ledger
+	if !settings.isAdmin(caller) {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	migration := IdentityMigration{}
+	err = json.Unmarshal([]byte(args[0]), &migration)
+	if err != nil {
+		return shim.Error("Error parsing migration json")
+	}
+
+	if migration.DefaultMspId == "" {
+		return shim.Error("Bad request: defaultMspId is missing")
+	}
+
+	done, err := stub.GetState(KeyIdentityMigration)
+	if err != nil {
+		return shim.Error("Error reading migration state: " + err.Error())
+	} else if done != nil {
+		return shim.Error("Identities have already been migrated in transaction " + string(done))
+	}
+
+	result := map[string]int{}
+	for _, index := range identityIndexes {
+		n, err := t.migrateIdentityIndex(stub, index, &migration)
+		if err != nil {
+			return shim.Error("Error migrating '" + index.prefix + "': " + err.Error())
+		}
+		result[index.prefix] = n
+	}
+
+	// the former single admin is bound to the MSP the migration names for it, like every other name
+	if settings.Admin != "" {
+		mspId, _ := SplitIdentity(migration.identity(settings.Admin))
+		admin := settings.bindLegacyAdmin(mspId)
+
+		err = t.putSettings(stub, settings)
+		if err != nil {
+			return shim.Error("Error saving settings: " + err.Error())
+		}
+
+		by := AdminIdentity{}
+		by.MspId, by.CN = SplitIdentity(caller)
+		_, err = t.auditAdminChanges(stub, by, []AdminAuditEntry{{Action: "bind", Admin: admin}})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = stub.PutState(KeyIdentityMigration, []byte(stub.GetTxID()))
+	if err != nil {
+		return shim.Error("Error saving migration state: " + err.Error())
+	}
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	return shim.Success(resultJson)
+}
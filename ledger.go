@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// the role whose balance the index holds
+func prefixRole(prefix string) string {
+	switch prefix {
+	case IndexBank:
+		return "bank"
+	case IndexShop:
+		return "shop"
+	}
+	return "customer"
+}
+
+// the optional memo of a request, booked with the ledger entries of the transaction
+func requestMemo(args []string) string {
+	movement := Movement{}
+	if len(args) == 1 {
+		json.Unmarshal([]byte(args[0]), &movement)
+	}
+	return movement.Memo
+}
+
+// the index of the next entry within the transaction
+func nextLedgerSeq(stub shim.ChaincodeStubInterface) (string, error) {
+	tx, ok := stub.(*invocation)
+	if !ok {
+		return "", errors.New("ledger entries can only be booked by an invocation")
+	}
+
+	n := tx.ledgerEntries
+	tx.ledgerEntries++
+	return fmt.Sprintf("%06d", n), nil
+}
+
+// books a balance change of the account, the keys sort the entries of an owner by time
+func (t *LoyaltyChaincode) appendLedger(stub shim.ChaincodeStubInterface, prefix string, cn string, movement Movement, amount uint64, debit bool, balance uint64) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+
+	entry := LedgerEntry{
+		Account:   prefixRole(prefix),
+		Movement:  movement,
+		Amount:    amount,
+		Debit:     debit,
+		Balance:   balance,
+		TxId:      stub.GetTxID(),
+		Timestamp: now,
+	}
+
+	seq, err := nextLedgerSeq(stub)
+	if err != nil {
+		return err
+	}
+
+	data, _ := json.Marshal(entry)
+	key, _ := stub.CreateCompositeKey(IndexLedger, []string{cn, fmt.Sprintf("%020d", now), stub.GetTxID(), seq})
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error saving ledger entry of '" + cn + "':" + err.Error())
+	}
+
+	return nil
+}
+
+// the ledger entries of all accounts of the caller, oldest first
+func (t *LoyaltyChaincode) getLedger(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	query, err := t.parseListQuery(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var result []*LedgerEntry = []*LedgerEntry{}
+	visit := func(key string, value []byte) (bool, error) {
+		entry := LedgerEntry{}
+		err := json.Unmarshal(value, &entry)
+		if err != nil {
+			return false, errors.New("ledger entry parsing error: " + err.Error())
+		}
+
+		if !query.inRange(entry.Timestamp) || (query.Counterparty != "" && entry.Counterparty != query.Counterparty) {
+			return false, nil
+		}
+
+		result = append(result, &entry)
+		return true, nil
+	}
+	bookmark, err := t.visitPage(stub, IndexLedger, []string{caller}, query.PageQuery, visit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a match found by the probe isn't part of the page
+	count := len(result)
+	err = t.sortable(stub, query, IndexLedger, []string{caller}, bookmark, visit)
+	result = result[:count]
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	sortRecords(result, query.Sort, func(i int) int64 {
+		return result[i].Timestamp
+	}, func(i int) uint64 {
+		return result[i].Amount
+	})
+
+	return pageResponse(result, len(result), bookmark)
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// the increase and decrease of a counter, an overflow is kept to fail the transaction when the counter is written
+type counterDelta struct {
+	plus  uint64
+	minus uint64
+	err   error
+}
+
+func (c *counterDelta) up(value uint64) {
+	c.plus = c.add(c.plus, value)
+}
+
+func (c *counterDelta) down(value uint64) {
+	c.minus = c.add(c.minus, value)
+}
+
+func (c *counterDelta) add(sum uint64, value uint64) uint64 {
+	result, err := Amount(sum).Add(Amount(value))
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return uint64(result)
+}
+
+// the changes of a transaction to the counters of one bank
+type liabilityDelta struct {
+	issued      counterDelta
+	outstanding counterDelta
+	pending     counterDelta
+	claimed     counterDelta
+}
+
+// the changes per bank, a transaction must write the counters of a bank only once
+type liabilityDeltas map[string]*liabilityDelta
+
+func (d liabilityDeltas) of(bank string) *liabilityDelta {
+	if d[bank] == nil {
+		d[bank] = &liabilityDelta{}
+	}
+	return d[bank]
+}
+
+// a counter which would overflow or fall below 0 fails the transaction, the counters must match the points they count
+func applyDelta(counter *uint64, delta counterDelta) error {
+	if delta.err != nil {
+		return delta.err
+	}
+
+	result, err := Amount(*counter).Add(Amount(delta.plus))
+	if err == nil {
+		result, err = result.Sub(Amount(delta.minus))
+	}
+	if err != nil {
+		return err
+	}
+
+	*counter = uint64(result)
+	return nil
+}
+
+// all points of the bank held by customers, locked or not
+func (l *BankLiability) held() uint64 {
+	return l.Outstanding + l.PendingRedemption
+}
+
+func (t *LoyaltyChaincode) getLiability(stub shim.ChaincodeStubInterface, bank string) (*BankLiability, error) {
+	key, _ := stub.CreateCompositeKey(IndexBankLiability, []string{bank})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Error fetching liability:" + err.Error())
+	}
+
+	liability := BankLiability{}
+	if data != nil {
+		err = json.Unmarshal(data, &liability)
+		if err != nil {
+			return nil, errors.New("Error parsing liability:" + err.Error())
+		}
+	}
+	liability.Bank = bank
+
+	return &liability, nil
+}
+
+func (t *LoyaltyChaincode) changeLiabilities(stub shim.ChaincodeStubInterface, deltas liabilityDeltas) error {
+	var banks []string
+	for bank := range deltas {
+		banks = append(banks, bank)
+	}
+	sort.Strings(banks)
+
+	for _, bank := range banks {
+		liability, err := t.getLiability(stub, bank)
+		if err != nil {
+			return err
+		}
+
+		delta := deltas[bank]
+		counters := []struct {
+			name    string
+			counter *uint64
+			delta   counterDelta
+		}{
+			{"issued", &liability.Issued, delta.issued},
+			{"outstanding", &liability.Outstanding, delta.outstanding},
+			{"pendingRedemption", &liability.PendingRedemption, delta.pending},
+			{"claimed", &liability.Claimed, delta.claimed},
+		}
+		for _, c := range counters {
+			err = applyDelta(c.counter, c.delta)
+			if err != nil {
+				return errors.New("Error changing " + c.name + " liability of '" + bank + "': " + err.Error())
+			}
+		}
+
+		data, _ := json.Marshal(liability)
+		key, _ := stub.CreateCompositeKey(IndexBankLiability, []string{bank})
+		err = stub.PutState(key, data)
+		if err != nil {
+			return errors.New("Error saving liability of '" + bank + "':" + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// the points of a customer locked in allowances, per issuing bank
+func (t *LoyaltyChaincode) getPendingRedemptions(stub shim.ChaincodeStubInterface, customer string) (map[string]uint64, error) {
+	key, _ := stub.CreateCompositeKey(IndexCustomerPending, []string{customer})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Error fetching pending redemptions:" + err.Error())
+	}
+
+	pending := map[string]uint64{}
+	if data != nil {
+		err = json.Unmarshal(data, &pending)
+		if err != nil {
+			return nil, errors.New("Error parsing pending redemptions:" + err.Error())
+		}
+	}
+
+	return pending, nil
+}
+
+func (t *LoyaltyChaincode) putPendingRedemptions(stub shim.ChaincodeStubInterface, customer string, pending map[string]uint64) error {
+	for bank, value := range pending {
+		if value == 0 {
+			delete(pending, bank)
+		}
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexCustomerPending, []string{customer})
+	if len(pending) == 0 {
+		return stub.DelState(key)
+	}
+
+	data, _ := json.Marshal(pending)
+	return stub.PutState(key, data)
+}
+
+// allowances don't earmark assets, so a redemption is booked on the banks of the assets
+// the customer would spend next, after the ones already locked by earlier redemptions
+func (t *LoyaltyChaincode) lockPending(stub shim.ChaincodeStubInterface, customer string, value uint64, now int64) (map[string]uint64, error) {
+	pending, err := t.getPendingRedemptions(stub, customer)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := t.spendOptions(stub, SpendOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	assets, err := t.listAssets(stub, IndexCustomerAsset, customer)
+	if err != nil {
+		return nil, err
+	}
+	sortAssets(assets, options)
+
+	locked := map[string]uint64{}
+	for bank, value := range pending {
+		locked[bank] = value
+	}
+
+	result := map[string]uint64{}
+	rest := value
+	for _, entry := range assets {
+		if rest == 0 {
+			break
+		}
+		if entry.Asset.Frozen || entry.Asset.expired(now) {
+			continue
+		}
+
+		bank := entry.Asset.History[0]
+		free := entry.Asset.Value
+		if locked[bank] >= free {
+			locked[bank] -= free
+			continue
+		}
+		free -= locked[bank]
+		locked[bank] = 0
+
+		if free > rest {
+			free = rest
+		}
+		result[bank] += free
+		pending[bank] += free
+		rest -= free
+	}
+
+	err = t.putPendingRedemptions(stub, customer, pending)
+	if err != nil {
+		return nil, errors.New("Error saving pending redemptions:" + err.Error())
+	}
+
+	return result, nil
+}
+
+// unlocks value of the pending redemptions of the customer, the banks of prefer first
+func (t *LoyaltyChaincode) unlockPending(stub shim.ChaincodeStubInterface, customer string, value uint64, prefer map[string]uint64) (map[string]uint64, error) {
+	pending, err := t.getPendingRedemptions(stub, customer)
+	if err != nil {
+		return nil, err
+	}
+
+	var banks []string
+	for bank := range pending {
+		banks = append(banks, bank)
+	}
+	sort.Strings(banks)
+
+	result := map[string]uint64{}
+	rest := value
+	unlock := func(bank string, max uint64) {
+		if max > pending[bank] {
+			max = pending[bank]
+		}
+		if max > rest {
+			max = rest
+		}
+		if max == 0 {
+			return
+		}
+		pending[bank] -= max
+		result[bank] += max
+		rest -= max
+	}
+
+	for _, bank := range banks {
+		unlock(bank, prefer[bank])
+	}
+	for _, bank := range banks {
+		unlock(bank, pending[bank])
+	}
+
+	err = t.putPendingRedemptions(stub, customer, pending)
+	if err != nil {
+		return nil, errors.New("Error saving pending redemptions:" + err.Error())
+	}
+
+	return result, nil
+}
+
+// points taken from a customer may be the ones its pending redemptions were booked on. The part of the pending
+// redemptions the remaining assets of a bank can't cover is moved to the banks of the assets the customer would
+// spend next. assets are the assets of the customer before removed were taken.
+func (t *LoyaltyChaincode) movePendingOfRemoved(stub shim.ChaincodeStubInterface, customer string, assets []assetEntry, removed map[string]uint64, deltas liabilityDeltas) error {
+	pending, err := t.getPendingRedemptions(stub, customer)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	held := map[string]uint64{}
+	for _, entry := range assets {
+		held[entry.Asset.History[0]] += entry.Asset.Value
+	}
+	for bank, value := range removed {
+		held[bank] -= value
+	}
+
+	var banks []string
+	for bank := range pending {
+		banks = append(banks, bank)
+	}
+	sort.Strings(banks)
+
+	moved := uint64(0)
+	for _, bank := range banks {
+		if pending[bank] > held[bank] {
+			excess := pending[bank] - held[bank]
+			pending[bank] = held[bank]
+			deltas.of(bank).pending.down(excess)
+			deltas.of(bank).outstanding.up(excess)
+			moved += excess
+		}
+	}
+	if moved == 0 {
+		return nil
+	}
+
+	options, err := t.spendOptions(stub, SpendOptions{})
+	if err != nil {
+		return err
+	}
+	sorted := append([]assetEntry{}, assets...)
+	sortAssets(sorted, options)
+
+	for _, entry := range sorted {
+		if moved == 0 {
+			break
+		}
+
+		bank := entry.Asset.History[0]
+		free := held[bank] - pending[bank]
+		if free > moved {
+			free = moved
+		}
+		pending[bank] += free
+		deltas.of(bank).pending.up(free)
+		deltas.of(bank).outstanding.down(free)
+		moved -= free
+	}
+
+	err = t.putPendingRedemptions(stub, customer, pending)
+	if err != nil {
+		return errors.New("Error saving pending redemptions:" + err.Error())
+	}
+	return nil
+}
+
+// gives the released redemptions of the customers back to the outstanding points of their banks
+func (t *LoyaltyChaincode) releasePending(stub shim.ChaincodeStubInterface, released map[string]uint64) error {
+	var customers []string
+	for customer := range released {
+		customers = append(customers, customer)
+	}
+	sort.Strings(customers)
+
+	deltas := liabilityDeltas{}
+	for _, customer := range customers {
+		unlocked, err := t.unlockPending(stub, customer, released[customer], nil)
+		if err != nil {
+			return err
+		}
+		for bank, value := range unlocked {
+			deltas.of(bank).outstanding.up(value)
+			deltas.of(bank).pending.down(value)
+		}
+	}
+
+	err := t.changeLiabilities(stub, deltas)
+	if err != nil {
+		return errors.New("Error updating liability: " + err.Error())
+	}
+	return nil
+}
+
+// moves the pending redemptions of all customers from one bank to another
+func (t *LoyaltyChaincode) transferPendingRedemptions(stub shim.ChaincodeStubInterface, from string, to string) error {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomerPending, []string{})
+	if err != nil {
+		return errors.New("Could not build pending redemption iterator: " + err.Error())
+	}
+
+	var customers []string
+	var moved []map[string]uint64
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return err
+		}
+
+		pending := map[string]uint64{}
+		err = json.Unmarshal(kv.Value, &pending)
+		if err != nil {
+			iterator.Close()
+			return errors.New("Error parsing pending redemptions:" + err.Error())
+		}
+
+		if pending[from] == 0 {
+			continue
+		}
+		pending[to] += pending[from]
+		delete(pending, from)
+
+		_, parts, _ := stub.SplitCompositeKey(kv.Key)
+		customers = append(customers, parts[0])
+		moved = append(moved, pending)
+	}
+	iterator.Close()
+
+	for i, customer := range customers {
+		err = t.putPendingRedemptions(stub, customer, moved[i])
+		if err != nil {
+			return errors.New("Error saving pending redemptions:" + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// the counters of the calling bank, the admin may ask for any bank or, without bank, for the total supply
+func (t *LoyaltyChaincode) getBankLiability(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	request := BankLiability{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &request)
+		if err != nil {
+			return shim.Error("Error parsing arguments")
+		}
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+	admin := settings.isAdmin(caller)
+
+	if request.Bank == "" && !admin {
+		request.Bank = caller
+	}
+	err = t.resolveActors(stub, &request.Bank)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	if request.Bank != "" {
+		if request.Bank != caller && !admin {
+			return shim.Error("Only the admin can read the liability of another bank")
+		}
+		if !t.userExists(stub, request.Bank, "bank") {
+			return shim.Error("Bad request: bank doesn't exist")
+		}
+
+		liability, err := t.getLiability(stub, request.Bank)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		data, _ := json.Marshal(liability)
+		return shim.Success(data)
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexBankLiability, []string{})
+	if err != nil {
+		return shim.Error("Could not build liability iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	total := BankLiability{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		liability := BankLiability{}
+		err = json.Unmarshal(kv.Value, &liability)
+		if err != nil {
+			return shim.Error("Error parsing liability:" + err.Error())
+		}
+
+		for _, add := range [][2]*uint64{
+			{&total.Issued, &liability.Issued},
+			{&total.Outstanding, &liability.Outstanding},
+			{&total.PendingRedemption, &liability.PendingRedemption},
+			{&total.Claimed, &liability.Claimed},
+		} {
+			err = addAmount(add[0], *add[1])
+			if err != nil {
+				return shim.Error("Error summing liabilities: " + err.Error())
+			}
+		}
+	}
+
+	data, _ := json.Marshal(total)
+	return shim.Success(data)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 //	"strings"
 	"strconv"
@@ -12,7 +13,17 @@ import (
 type LoyaltyChaincode struct {
 }
 
+// the stub of a single invocation, it numbers what the invocation creates
+// so that every endorsing peer derives the same keys
+type invocation struct {
+	shim.ChaincodeStubInterface
+	assets        uint64
+	ledgerEntries uint64
+}
+
 const KeySettings = "__settings"
+const KeyAssetIdMigration = "__migration~assetIds"
+const KeyIdentityMigration = "__migration~identities"
 const IndexCustomer = "cn~customer"
 const IndexCustomerAsset = "cn~customer~asset"
 const IndexCustomerAllowances = "cn~customer~allowances"
@@ -22,6 +33,23 @@ const IndexBanksCustomers = "cn~bank~customer"
 const IndexShop = "cn~shop"
 const IndexShopAsset = "cn~shop~asset"
 const IndexShopAllowances = "cn~shop~allowances"
+const IndexBankExpiryPolicy = "cn~bank~expiry"
+const IndexBankExpired = "cn~bank~expired"
+const IndexSettlement = "cn~settlement"
+const IndexNettingReport = "cn~netting"
+const IndexBankRetired = "cn~bank~retired"
+const IndexAdminAudit = "cn~admin~audit"
+const IndexIdentity = "cn~identity"
+const IndexActor = "cn~actor"
+const IndexProfile = "cn~profile"
+const IndexBankOffboarding = "cn~bank~offboarding"
+const IndexBankQuota = "cn~bank~quota"
+const IndexBankIssuance = "cn~bank~issuance"
+const IndexBankLiability = "cn~bank~liability"
+const IndexCustomerPending = "cn~customer~pending"
+const IndexBankRegistrations = "cn~bank~registration"
+const IndexRoleRegistrations = "cn~role~registration"
+const IndexLedger = "cn~ledger"
 
 func (t *LoyaltyChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
@@ -43,6 +71,25 @@ func (t *LoyaltyChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error("Error parsing settings json")
 	}
 
+	// a CN-only admin is only read from the state of former versions, until migrateIdentities binds it
+	if settings.Admin != "" {
+		return shim.Error("Bad request: 'admin' is only known by its CN, pass 'admins' with their 'mspId'")
+	}
+
+	if len(settings.Admins) == 0 {
+		return shim.Error("Settings need at least one admin")
+	}
+
+	err = validIdentities(settings.Admins)
+	if err != nil {
+		return shim.Error("admins: " + err.Error())
+	}
+
+	err = validIdentities(settings.Auditors)
+	if err != nil {
+		return shim.Error("auditors: " + err.Error())
+	}
+
 	err = stub.PutState(KeySettings, []byte(args[0]))
 	if err != nil {
 		return shim.Error("Error saving token data")
@@ -52,8 +99,17 @@ func (t *LoyaltyChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 }
 
 func (t *LoyaltyChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	stub = &invocation{ChaincodeStubInterface: stub}
 	function, args := stub.GetFunctionAndParameters()
 
+	// suspended and closed actors can't change the ledger anymore
+	if mutatingFunctions[function] {
+		err := t.checkCallerActive(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
 	// call routing
 	switch function {
 	case "info":
@@ -87,6 +143,90 @@ func (t *LoyaltyChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 		return t.getCustomersAllowances(stub, args)
 	case "withdraw":
 		return t.withdraw(stub, args)
+	case "cancelRedemption":
+		return t.cancelRedemption(stub, args)
+	case "releaseExpiredAllowances":
+		return t.releaseExpiredAllowances(stub, args)
+	case "refund":
+		return t.refund(stub, args)
+	case "clawback":
+		return t.clawback(stub, args)
+	case "burn":
+		return t.burn(stub, args)
+	case "getRetirements":
+		return t.getRetirements(stub, args)
+	case "addAdmin":
+		return t.changeAdmins(stub, args, "add")
+	case "removeAdmin":
+		return t.changeAdmins(stub, args, "remove")
+	case "rotateAdmin":
+		return t.changeAdmins(stub, args, "rotate")
+	case "addAuditor":
+		return t.changeAuditors(stub, args, "addAuditor")
+	case "removeAuditor":
+		return t.changeAuditors(stub, args, "removeAuditor")
+	case "getAdminAudit":
+		return t.getAdminAudit(stub, args)
+	case "migrateAssetIds":
+		return t.migrateAssetIds(stub, args)
+	case "migrateIdentities":
+		return t.migrateIdentities(stub, args)
+	case "updateActor":
+		return t.updateActor(stub, args)
+	case "getActor":
+		return t.getActorInfo(stub, args)
+	case "listActors":
+		return t.listActors(stub, args, "")
+	case "getBanks":
+		return t.listActors(stub, args, "bank")
+	case "getShops":
+		return t.listActors(stub, args, "shop")
+	case "freezeAccount":
+		return t.changeAccountStatus(stub, args, ActorSuspended)
+	case "unfreezeAccount":
+		return t.changeAccountStatus(stub, args, ActorActive)
+	case "setIssuanceQuota":
+		return t.setIssuanceQuota(stub, args)
+	case "getIssuanceQuota":
+		return t.getIssuanceQuota(stub, args)
+	case "getBankLiability":
+		return t.getBankLiability(stub, args)
+	case "getLedger":
+		return t.getLedger(stub, args)
+	case "auditInvariants":
+		return t.auditInvariants(stub, args)
+	case "offboardBank":
+		return t.offboardBank(stub, args)
+	case "closeAccount":
+		return t.closeAccount(stub, args)
+	case "freezeFragment":
+		return t.freezeFragment(stub, args, true)
+	case "unfreezeFragment":
+		return t.freezeFragment(stub, args, false)
+	case "register":
+		return t.register(stub, args)
+	case "approveRegistration":
+		return t.decideRegistration(stub, args, true)
+	case "rejectRegistration":
+		return t.decideRegistration(stub, args, false)
+	case "getRegistrations":
+		return t.getRegistrations(stub, args)
+	case "setExpiryPolicy":
+		return t.setExpiryPolicy(stub, args)
+	case "expirePoints":
+		return t.expirePoints(stub, args)
+	case "openSettlement":
+		return t.openSettlement(stub, args)
+	case "recordSettlementPayment":
+		return t.recordSettlementPayment(stub, args)
+	case "confirmSettlement":
+		return t.confirmSettlement(stub, args)
+	case "getSettlements":
+		return t.getSettlements(stub, args)
+	case "computeNetting":
+		return t.computeNetting(stub, args)
+	case "getNettingReport":
+		return t.getNettingReport(stub, args)
 	default:
 		return shim.Error("Incorrect function name: " + function)
 	}
@@ -117,13 +257,13 @@ func (t *LoyaltyChaincode) createActors(stub shim.ChaincodeStubInterface, args [
 		return shim.Error("Error getting settings")
 	}
 
-	caller, err := CallerCN(stub)
+	caller, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
 
 	// only admin is able to create another users
-	if caller != settings.Admin {
+	if !settings.isAdmin(caller) {
 		return shim.Error("I don't know you, " + caller + "!")
 	}
 
@@ -133,11 +273,42 @@ func (t *LoyaltyChaincode) createActors(stub shim.ChaincodeStubInterface, args [
 		return shim.Error("Error parsing users[] json")
 	}
 
+	// the roles of an identity are created together, the registry record is written once per identity
+	var ids []string
+	roles := map[string][]string{}
+	metadata := map[string]map[string]string{}
+	profiles := map[string]*Profile{}
+
+	callerMspId, _ := SplitIdentity(caller)
 	for i := 0; i < len(users); i++ {
-		err := t.createUser(stub, users[i].Name, users[i].Role)
+		// a bare name is an identity of the given MSP, by default the one of the admin
+		if isLegacyIdentity(users[i].Name) {
+			mspId := users[i].MspId
+			if mspId == "" {
+				mspId = callerMspId
+			}
+			users[i].Name = IdentityOf(mspId, users[i].Name)
+		}
+		users[i].MspId, _ = SplitIdentity(users[i].Name)
 
+		id := users[i].Name
+		if _, ok := roles[id]; !ok {
+			ids = append(ids, id)
+			metadata[id] = map[string]string{}
+		}
+		roles[id] = append(roles[id], users[i].Role)
+		for k, v := range users[i].Metadata {
+			metadata[id][k] = v
+		}
+		if users[i].Profile != nil {
+			profiles[id] = users[i].Profile
+		}
+	}
+
+	for _, id := range ids {
+		_, err := t.createActor(stub, id, roles[id], metadata[id], profiles[id])
 		if err != nil {
-			return shim.Error("Error creating user '" + users[i].Name + "'")
+			return shim.Error("Error creating user '" + id + "': " + err.Error())
 		}
 	}
 
@@ -150,42 +321,54 @@ func (t *LoyaltyChaincode) createActors(stub shim.ChaincodeStubInterface, args [
 
 func (t *LoyaltyChaincode) getAllCostumerNames(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	// names of customers are only visible to the admin
+	visible, err := t.visibleRoles(stub, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if !visible["customer"] {
+		return shim.Error("Only the admin can list customers")
+	}
 
-	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomer, []string{})
+	query, err := t.parseListQuery(stub, args)
 	if err != nil {
-		return shim.Error("Could not build invoice iterator: " + err.Error())
+		return shim.Error(err.Error())
 	}
-	defer iterator.Close()
 
 	var result []*string = []*string{}
-	for i := 0; iterator.HasNext(); i++ {
-		kv, err := iterator.Next()
-
+	bookmark, err := t.visitPage(stub, IndexCustomer, []string{}, query.PageQuery, func(key string, value []byte) (bool, error) {
+		_, parts, err := stub.SplitCompositeKey(key)
 		if err != nil {
-			return shim.Error(err.Error())
+			return false, err
 		}
-
-		_, parts, err := stub.SplitCompositeKey(kv.Key)
 		cName := parts[0]
 
 		result = append(result, &cName)
-	}
-
-	resultJson, err := json.Marshal(result)
+		return true, nil
+	})
 	if err != nil {
-		return shim.Error("Could not marshal json: " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success(resultJson)
+	return pageResponse(result, len(result), bookmark)
 }
 
 func (t *LoyaltyChaincode) getUserBalance(stub shim.ChaincodeStubInterface, args []string, role string) pb.Response {
 
-	caller, err := CallerCN(stub)
+	caller, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
 
+	query, err := t.parseListQuery(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	prefix := IndexCustomer
 	switch role{
 	case "shop":
@@ -204,9 +387,22 @@ func (t *LoyaltyChaincode) getUserBalance(stub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return shim.Error("Failed to fetch entry history:" + err.Error())
 	}
+	history = query.filterHistory(history)
+	sortRecords(history, query.Sort, func(i int) int64 {
+		return history[i].Timestamp
+	}, func(i int) uint64 {
+		value, _ := strconv.ParseUint(history[i].Value, 10, 64)
+		return value
+	})
+
+	profile, err := t.getProfile(stub, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	balanceJson := User{
 		Name:  caller,
+		Profile: profile,
 		Balance: balance,
 		BalanceHistory: history,
 	}
@@ -217,7 +413,7 @@ func (t *LoyaltyChaincode) getUserBalance(stub shim.ChaincodeStubInterface, args
 
 func (t *LoyaltyChaincode) customerBalanceInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	caller, err := CallerCN(stub)
+	caller, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
@@ -226,32 +422,32 @@ func (t *LoyaltyChaincode) customerBalanceInfo(stub shim.ChaincodeStubInterface,
 		return shim.Error("I don't know you, " + caller + "!")
 	}
 
-	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomerAsset, []string{caller})
+	query, err := t.parseListQuery(stub, args)
 	if err != nil {
-		return shim.Error("Could not build invoice iterator: " + err.Error())
+		return shim.Error(err.Error())
 	}
-	defer iterator.Close()
 
 	var result []*TransferEvent = []*TransferEvent{}
-	for i := 0; iterator.HasNext(); i++ {
-		kv, err := iterator.Next()
-
+	visit := func(key string, value []byte) (bool, error) {
+		info, err := t.getEntryInfo(stub, key)
 		if err != nil {
-			return shim.Error(err.Error())
+			return false, errors.New("Failed to fetch entry info:" + err.Error())
 		}
 
-		info, err := t.getEntryInfo(stub, kv.Key)
+		_, parts, err := stub.SplitCompositeKey(key)
 		if err != nil {
-			return shim.Error("Failed to fetch entry info:" + err.Error())
+			return false, err
 		}
-
-		_, parts, err := stub.SplitCompositeKey(kv.Key)
 		spender := parts[1]
 
 		asset := Asset {}
-		err = json.Unmarshal([]byte(kv.Value), &asset)
+		err = json.Unmarshal(value, &asset)
 		if err != nil {
-			return shim.Error("asset parsing error: " + err.Error())
+			return false, errors.New("asset parsing error: " + err.Error())
+		}
+
+		if !query.inRange(info.Timestamp) || (query.Bank != "" && asset.History[0] != query.Bank) {
+			return false, nil
 		}
 
 		transfer := TransferEvent {
@@ -262,19 +458,33 @@ func (t *LoyaltyChaincode) customerBalanceInfo(stub shim.ChaincodeStubInterface,
 		}
 
 		result = append(result, &transfer)
+		return true, nil
+	}
+	bookmark, err := t.visitPage(stub, IndexCustomerAsset, query.keys(caller), query.PageQuery, visit)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	resultJson, err := json.Marshal(result)
+	// a match found by the probe isn't part of the page
+	count := len(result)
+	err = t.sortable(stub, query, IndexCustomerAsset, query.keys(caller), bookmark, visit)
+	result = result[:count]
 	if err != nil {
-		return shim.Error("Could not marshal json: " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success(resultJson)
+	sortRecords(result, query.Sort, func(i int) int64 {
+		return result[i].Info.Timestamp
+	}, func(i int) uint64 {
+		return result[i].Value
+	})
+
+	return pageResponse(result, len(result), bookmark)
 }
 
 func (t *LoyaltyChaincode) getShopClaims(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	bank, err := CallerCN(stub)
+	bank, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
@@ -283,47 +493,58 @@ func (t *LoyaltyChaincode) getShopClaims(stub shim.ChaincodeStubInterface, args
 		return shim.Error("I don't know you, " + bank + "!")
 	}
 
-	iterator, err := stub.GetStateByPartialCompositeKey(IndexBankAsset, []string{bank})
+	query, err := t.parseListQuery(stub, args)
 	if err != nil {
-		return shim.Error("Could not build invoice iterator: " + err.Error())
+		return shim.Error(err.Error())
 	}
-	defer iterator.Close()
 
 	var result []*Asset = []*Asset{}
-	for i := 0; iterator.HasNext(); i++ {
-		kv, err := iterator.Next()
-
+	visit := func(key string, value []byte) (bool, error) {
+		info, err := t.getEntryInfo(stub, key)
 		if err != nil {
-			return shim.Error(err.Error())
+			return false, errors.New("Failed to fetch entry history:" + err.Error())
 		}
 
-		info, err := t.getEntryInfo(stub, kv.Key)
-		if err != nil {
-			return shim.Error("Failed to fetch entry history:" + err.Error())
+		if !query.inRange(info.Timestamp) {
+			return false, nil
 		}
 
 		asset := Asset {}
-		err = json.Unmarshal([]byte(kv.Value), &asset)
+		err = json.Unmarshal(value, &asset)
 		if err != nil {
-			return shim.Error("asset parsing error: " + err.Error())
+			return false, errors.New("asset parsing error: " + err.Error())
 		}
 
 		asset.Info = *info
 
 		result = append(result, &asset)
+		return true, nil
+	}
+	bookmark, err := t.visitPage(stub, IndexBankAsset, query.keys(bank), query.PageQuery, visit)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	resultJson, err := json.Marshal(result)
+	// a match found by the probe isn't part of the page
+	count := len(result)
+	err = t.sortable(stub, query, IndexBankAsset, query.keys(bank), bookmark, visit)
+	result = result[:count]
 	if err != nil {
-		return shim.Error("Could not marshal json: " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success(resultJson)
+	sortRecords(result, query.Sort, func(i int) int64 {
+		return result[i].Info.Timestamp
+	}, func(i int) uint64 {
+		return result[i].Value
+	})
+
+	return pageResponse(result, len(result), bookmark)
 }
 
 func (t *LoyaltyChaincode) getBankObligations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	shop, err := CallerCN(stub)
+	shop, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
@@ -332,45 +553,72 @@ func (t *LoyaltyChaincode) getBankObligations(stub shim.ChaincodeStubInterface,
 		return shim.Error("I don't know you, " + shop + "!")
 	}
 
-	iterator, err := stub.GetStateByPartialCompositeKey(IndexShopAsset, []string{shop})
+	query, err := t.parseListQuery(stub, args)
 	if err != nil {
-		return shim.Error("Could not build invoice iterator: " + err.Error())
+		return shim.Error(err.Error())
 	}
-	defer iterator.Close()
 
 	var result []*BankObligation = []*BankObligation{}
-	for i := 0; iterator.HasNext(); i++ {
-		kv, err := iterator.Next()
+	visit := func(key string, value []byte) (bool, error) {
+		asset := Asset {}
+		err := json.Unmarshal(value, &asset)
+		if err != nil {
+			return false, errors.New("asset parsing error: " + err.Error())
+		}
+
+		if query.Bank != "" && asset.History[0] != query.Bank {
+			return false, nil
+		}
 
+		info, err := t.getEntryInfo(stub, key)
 		if err != nil {
-			return shim.Error(err.Error())
+			return false, errors.New("Failed to fetch entry history:" + err.Error())
 		}
 
-		asset := Asset {}
-		err = json.Unmarshal([]byte(kv.Value), &asset)
+		if !query.inRange(info.Timestamp) {
+			return false, nil
+		}
+
+		_, parts, err := stub.SplitCompositeKey(key)
 		if err != nil {
-			return shim.Error("asset parsing error: " + err.Error())
+			return false, err
 		}
 
 		bankObligation := BankObligation {
 			Bank: asset.History[0],
+			Customer: parts[1],
 			Value: asset.Value,
+			Info: *info,
 		}
 
 		result = append(result, &bankObligation)
+		return true, nil
+	}
+	bookmark, err := t.visitPage(stub, IndexShopAsset, query.keys(shop), query.PageQuery, visit)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	resultJson, err := json.Marshal(result)
+	// a match found by the probe isn't part of the page
+	count := len(result)
+	err = t.sortable(stub, query, IndexShopAsset, query.keys(shop), bookmark, visit)
+	result = result[:count]
 	if err != nil {
-		return shim.Error("Could not marshal json: " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success(resultJson)
+	sortRecords(result, query.Sort, func(i int) int64 {
+		return result[i].Info.Timestamp
+	}, func(i int) uint64 {
+		return result[i].Value
+	})
+
+	return pageResponse(result, len(result), bookmark)
 }
 
 func (t *LoyaltyChaincode) provideAsset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	caller, err := CallerCN(stub)
+	caller, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
@@ -386,15 +634,35 @@ func (t *LoyaltyChaincode) provideAsset(stub shim.ChaincodeStubInterface, args [
 
 	params := Transfer{}
 	err = json.Unmarshal([]byte(args[0]), &params)
-	if params.Receiver == "" || params.Value <= 0 {
+	if err != nil || params.Receiver == "" {
 		return shim.Error("Bad request: wrong params!")
 	}
 
+	_, err = NewAmount(params.Value)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	err = t.resolveActors(stub, &params.Receiver)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
 	if !t.userExists(stub, params.Receiver, "customer") {
 		return shim.Error("Bad request: receiver doesn't exist")
 	}
 
-	err = t.makeGiftToTheUserAsBank(stub, caller, params.Receiver, params.Value);
+	err = t.checkActive(stub, params.Receiver)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	err = t.useIssuanceQuota(stub, caller, params.Value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.makeGiftToTheUserAsBank(stub, caller, params.Receiver, params.Value, requestMemo(args));
 	if err != nil {
 		return shim.Error("Could not commit gift to the user: " + err.Error())
 	}
@@ -404,7 +672,7 @@ func (t *LoyaltyChaincode) provideAsset(stub shim.ChaincodeStubInterface, args [
 
 func (t *LoyaltyChaincode) getMyCustomerList(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	caller, err := CallerCN(stub)
+	caller, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
@@ -414,24 +682,43 @@ func (t *LoyaltyChaincode) getMyCustomerList(stub shim.ChaincodeStubInterface, a
 		return shim.Error("I don't know you, " + caller + "!")
 	}
 
-	customers, err := t.getBanksCustomers(stub, caller)
+	query, err := t.parseListQuery(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	customers, bookmark, err := t.getBanksCustomers(stub, caller, query)
 
 	if err != nil {
 		return shim.Error("Error getting banks customers: " + err.Error())
 	}
 
-	resultJson, err := json.Marshal(customers)
+	// every customer of the bank is listed, so any entry after the bookmark is another match
+	err = t.sortable(stub, query, IndexBanksCustomers, query.keys(caller), bookmark, func(key string, value []byte) (bool, error) {
+		return true, nil
+	})
 	if err != nil {
-		return shim.Error("Could not marshal json: " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success(resultJson)
+	// customers are ordered by the time of their last gift
+	sortRecords(customers, query.Sort, func(i int) int64 {
+		history := customers[i].BalanceHistory
+		if len(history) == 0 {
+			return 0
+		}
+		return history[len(history) - 1].Timestamp
+	}, func(i int) uint64 {
+		return customers[i].Balance
+	})
+
+	return pageResponse(customers, len(customers), bookmark)
 }
 
 
 func (t *LoyaltyChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	from, err := CallerCN(stub)
+	from, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
@@ -446,6 +733,11 @@ func (t *LoyaltyChaincode) transfer(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Error parsing transfer json")
 	}
 
+	err = t.resolveActors(stub, &transfer.Receiver)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
 	// to prevent "generating" tokens because of
 	// committed state reading
 	if from == transfer.Receiver {
@@ -456,8 +748,18 @@ func (t *LoyaltyChaincode) transfer(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Bad request: receiver doesn't exist")
 	}
 
+	err = t.checkActive(stub, transfer.Receiver)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
 
-	err = t.userToUserTransfer(stub, from, transfer.Receiver, transfer.Value)
+
+	options, err := t.spendOptions(stub, transfer.SpendOptions)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.userToUserTransfer(stub, from, transfer.Receiver, transfer.Value, options, requestMemo(args))
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -481,7 +783,7 @@ func main() {
 }
 
 func (t *LoyaltyChaincode) redeem(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	buyer, err := CallerCN(stub)
+	buyer, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
@@ -495,32 +797,79 @@ func (t *LoyaltyChaincode) redeem(stub shim.ChaincodeStubInterface, args []strin
 		return shim.Error("Error parsing arguments")
 	}
 
+	err = t.resolveActors(stub, &transfer.Receiver)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
 	if !t.userExists(stub, transfer.Receiver, "shop") {
 		return shim.Error("Bad request: shop doesn't exist")
 	}
 
+	err = t.checkActive(stub, transfer.Receiver)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	value, err := NewAmount(transfer.Value)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
 	userBalance, err := t.userBalance(stub, IndexCustomer, buyer)
 	if err != nil {
 		return shim.Error(err.Error())
-	} else if userBalance - transfer.Value > userBalance{
+	} else if _, err = Amount(userBalance).Sub(value); err != nil {
 		return shim.Error("User has not enough balance to proceed transaction")
 	}
 
-	allowance, err := t.updateAllowance(stub, IndexCustomerAllowances, buyer, transfer.Receiver, transfer.Value, false)
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	spendable, err := t.spendableBalance(stub, buyer, now)
 	if err != nil {
 		return shim.Error(err.Error())
+	} else if spendable < transfer.Value {
+		return shim.Error("User has not enough unexpired points to proceed transaction")
 	}
 
-	allowance, err = t.updateAllowance(stub, IndexShopAllowances, transfer.Receiver, buyer, transfer.Value, false)
+	deadline, err := t.allowanceDeadline(stub, transfer.Deadline, now)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	err = t.updateUserBalance(stub, IndexCustomer, buyer, transfer.Value, true)
+	allowance, err := t.updateAllowance(stub, IndexCustomerAllowances, buyer, transfer.Receiver, transfer.Value, false, deadline)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	allowance, err = t.updateAllowance(stub, IndexShopAllowances, transfer.Receiver, buyer, transfer.Value, false, deadline)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.updateUserBalance(stub, IndexCustomer, buyer, transfer.Value, true, Movement{LedgerRedeem, transfer.Receiver, requestMemo(args)})
 	if err != nil {
 		return shim.Error("Error creating allowance: " + err.Error())
 	}
 
+	locked, err := t.lockPending(stub, buyer, transfer.Value, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	deltas := liabilityDeltas{}
+	for bank, value := range locked {
+		deltas.of(bank).outstanding.down(value)
+		deltas.of(bank).pending.up(value)
+	}
+	err = t.changeLiabilities(stub, deltas)
+	if err != nil {
+		return shim.Error("Error updating liability: " + err.Error())
+	}
+
 	// send event
 	allowanceEvent := AllowanceEvent{}
 	allowanceEvent.Buyer = allowance.Buyer
@@ -532,8 +881,88 @@ func (t *LoyaltyChaincode) redeem(stub shim.ChaincodeStubInterface, args []strin
 	return shim.Success(nil)
 }
 
+// the customer (with the shop) or the shop (with the buyer) gives back the unwithdrawn part of a redemption,
+// a value of 0 cancels all of it
+func (t *LoyaltyChaincode) cancelRedemption(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+	if len(args) != 1 {
+		return shim.Error("cancelRedemption expected 1 argument")
+	}
+
+	request := RedemptionCancel{}
+	err = json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	err = t.resolveActors(stub, &request.Buyer, &request.Shop)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	if request.Buyer == "" {
+		request.Buyer = caller
+	} else if request.Shop == "" {
+		request.Shop = caller
+	} else if caller != request.Buyer && caller != request.Shop {
+		return shim.Error("Only the customer or the shop can cancel a redemption")
+	}
+
+	if !t.userExists(stub, request.Buyer, "customer") {
+		return shim.Error("Bad request: customer doesn't exist")
+	}
+	if !t.userExists(stub, request.Shop, "shop") {
+		return shim.Error("Bad request: shop doesn't exist")
+	}
+
+	allowance, err := t.getAllowance(stub, IndexCustomerAllowances, request.Buyer, request.Shop)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if request.Value == 0 {
+		request.Value = allowance.Value
+	}
+	if request.Value == 0 || request.Value > allowance.Value {
+		return shim.Error("Only " + uintToString(allowance.Value) + " of the redemption are not withdrawn yet")
+	}
+
+	_, err = t.updateAllowance(stub, IndexCustomerAllowances, request.Buyer, request.Shop, request.Value, true, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = t.updateAllowance(stub, IndexShopAllowances, request.Shop, request.Buyer, request.Value, true, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.updateUserBalance(stub, IndexCustomer, request.Buyer, request.Value, false, Movement{LedgerRelease, request.Shop, requestMemo(args)})
+	if err != nil {
+		return shim.Error("Error restoring customer balance: " + err.Error())
+	}
+
+	err = t.releasePending(stub, map[string]uint64{request.Buyer: request.Value})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// send event
+	allowanceEvent := AllowanceEvent{}
+	allowanceEvent.Buyer = request.Buyer
+	allowanceEvent.Shop = request.Shop
+	allowanceEvent.Value = request.Value
+	evtData, _ := json.Marshal(allowanceEvent)
+	stub.SetEvent("CancelRedemption", evtData)
+
+	return shim.Success(evtData)
+}
+
 func (t *LoyaltyChaincode) withdraw(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	shopCn, err := CallerCN(stub)
+	shopCn, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
@@ -547,11 +976,32 @@ func (t *LoyaltyChaincode) withdraw(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Error parsing arguments")
 	}
 
+	err = t.resolveActors(stub, &allowance.Buyer)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
 	if !t.userExists(stub, allowance.Buyer, "customer") {
 		return shim.Error("Bad request: customer doesn't exist")
 	}
 
-	err = t.withdrawUserAssets(stub, allowance.Buyer, shopCn, allowance.Value)
+	_, err = NewAmount(allowance.Value)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	requested := SpendOptions{}
+	err = json.Unmarshal([]byte(args[0]), &requested)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	options, err := t.spendOptions(stub, requested)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.withdrawUserAssets(stub, allowance.Buyer, shopCn, allowance.Value, options, requestMemo(args))
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -559,45 +1009,155 @@ func (t *LoyaltyChaincode) withdraw(stub shim.ChaincodeStubInterface, args []str
 	return shim.Success(nil)
 }
 
+func (t *LoyaltyChaincode) refund(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	shopCn, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+	if len(args) != 1 {
+		return shim.Error("refund expected 1 argument")
+	}
+
+	if !t.userExists(stub, shopCn, "shop") {
+		return shim.Error("I don't know you, " + shopCn + "!")
+	}
+
+	refund := Allowance{}
+	err = json.Unmarshal([]byte(args[0]), &refund)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	err = t.resolveActors(stub, &refund.Buyer)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	if !t.userExists(stub, refund.Buyer, "customer") {
+		return shim.Error("Bad request: customer doesn't exist")
+	}
+
+	err = t.checkActive(stub, refund.Buyer)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	_, err = NewAmount(refund.Value)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	err = t.refundUserAssets(stub, refund.Buyer, shopCn, refund.Value, requestMemo(args))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// send event
+	refundEvent := AllowanceEvent{}
+	refundEvent.Buyer = refund.Buyer
+	refundEvent.Shop = shopCn
+	refundEvent.Value = refund.Value
+	evtData, _ := json.Marshal(refundEvent)
+	stub.SetEvent("Refund", evtData)
+
+	return shim.Success(evtData)
+}
+
 func (t *LoyaltyChaincode) getCustomersAllowances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	caller, err := CallerCN(stub)
+	caller, err := CallerId(stub)
 	if err != nil {
 		return shim.Error("Error extracting user identity")
 	}
 
-	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomerAllowances, []string{caller})
+	query, err := t.parseListQuery(stub, args)
 	if err != nil {
-		return shim.Error("Could not build invoice iterator: " + err.Error())
+		return shim.Error(err.Error())
 	}
-	defer iterator.Close()
 
 	var result []*AllowanceEvent = []*AllowanceEvent{}
-	for i := 0; iterator.HasNext(); i++ {
-		kv, err := iterator.Next()
-
+	visit := func(key string, value []byte) (bool, error) {
+		allowance := Allowance {}
+		err := json.Unmarshal(value, &allowance)
 		if err != nil {
-			return shim.Error(err.Error())
+			return false, errors.New("allowance parsing error: " + err.Error())
 		}
 
-		allowance := Allowance {}
-		err = json.Unmarshal([]byte(kv.Value), &allowance)
+		info, err := t.getEntryInfo(stub, key)
 		if err != nil {
-			return shim.Error("allowance parsing error: " + err.Error())
+			return false, errors.New("Failed to fetch entry history:" + err.Error())
 		}
 
-		info, err := t.getEntryInfo(stub, kv.Key)
-		if err != nil {
-			return shim.Error("Failed to fetch entry history:" + err.Error())
+		if !query.inRange(info.Timestamp) {
+			return false, nil
 		}
 
 		allowanceEvent := AllowanceEvent{
 			Buyer: caller,
 			Shop: allowance.Buyer,
 			Value: allowance.Value,
+			Deadline: allowance.Deadline,
 			Info: *info,
 		}
 
 		result = append(result, &allowanceEvent)
+		return true, nil
+	}
+	bookmark, err := t.visitPage(stub, IndexCustomerAllowances, query.keys(caller), query.PageQuery, visit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a match found by the probe isn't part of the page
+	count := len(result)
+	err = t.sortable(stub, query, IndexCustomerAllowances, query.keys(caller), bookmark, visit)
+	result = result[:count]
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	sortRecords(result, query.Sort, func(i int) int64 {
+		return result[i].Info.Timestamp
+	}, func(i int) uint64 {
+		return result[i].Value
+	})
+
+	return pageResponse(result, len(result), bookmark)
+}
+func (t *LoyaltyChaincode) migrateAssetIds(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	// only admin is able to migrate the ledger
+	if !settings.isAdmin(caller) {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	done, err := stub.GetState(KeyAssetIdMigration)
+	if err != nil {
+		return shim.Error("Error reading migration state: " + err.Error())
+	} else if done != nil {
+		return shim.Error("Asset ids have already been migrated in transaction " + string(done))
+	}
+
+	result := map[string]int{}
+	for _, prefix := range []string{IndexCustomerAsset, IndexShopAsset, IndexBankAsset} {
+		n, err := t.migrateAssetIndex(stub, prefix)
+		if err != nil {
+			return shim.Error("Error migrating '" + prefix + "': " + err.Error())
+		}
+		result[prefix] = n
+	}
+
+	err = stub.PutState(KeyAssetIdMigration, []byte(stub.GetTxID()))
+	if err != nil {
+		return shim.Error("Error saving migration state: " + err.Error())
 	}
 
 	resultJson, err := json.Marshal(result)
@@ -606,4 +1166,4 @@ func (t *LoyaltyChaincode) getCustomersAllowances(stub shim.ChaincodeStubInterfa
 	}
 
 	return shim.Success(resultJson)
-}
\ No newline at end of file
+}
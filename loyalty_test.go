@@ -10,11 +10,13 @@ import (
 	"github.com/loyalty/chaincode/testdata"
 	"testing"
 	"fmt"
+	"math"
+	"reflect"
 	"strconv"
 )
 
 var settings = Settings{
-	Admin:        "testUser",
+	Admins:       []AdminIdentity{{MspId: "default", CN: "testUser"}},
 }
 
 func initToken(t *testing.T) *mock.FullMockStub {
@@ -29,17 +31,15 @@ func initToken(t *testing.T) *mock.FullMockStub {
 		t.Error("Loyalty cc init failed: " + res.Message)
 	}
 
-	st := Settings{Admin: "testUser"}
-	stBytes, _ := json.Marshal(st)
-	infoRes := stub.MockInvoke("1", util.ToChaincodeArgs("info", string(stBytes)))
-	settings := Settings{}
-	err := json.Unmarshal(infoRes.Payload, &settings)
+	infoRes := stub.MockInvoke("1", util.ToChaincodeArgs("info"))
+	info := Settings{}
+	err := json.Unmarshal(infoRes.Payload, &info)
 
 	if (err != nil) {
 		t.Error("Could not get info")
 	}
 
-	if settings.Admin != st.Admin {
+	if !reflect.DeepEqual(info.Admins, settings.Admins) {
 		t.Error("Chaincode admin name is wrong")
 	}
 
@@ -56,6 +56,10 @@ func createActors(t *testing.T, stub *mock.FullMockStub, body string)  {
 
 }
 
+func actorExists(stub *mock.FullMockStub, id string, role string) bool {
+	return (&LoyaltyChaincode{}).userExists(stub, id, role)
+}
+
 func provideAsset(t *testing.T, stub *mock.FullMockStub, body string)  {
 	res := stub.MockInvoke("1", util.ToChaincodeArgs("provideAsset", body))
 
@@ -106,7 +110,7 @@ func getMyCustomerList(t *testing.T, stub *mock.FullMockStub) []User {
 	}
 
 	var users = []User{}
-	err := json.Unmarshal(res.Payload, &users)
+	err := json.Unmarshal(res.Payload, &Page{Records: &users})
 	if err != nil {
 		t.Errorf("Failed to parse customer list: %s", err.Error())
 		t.FailNow()
@@ -178,7 +182,7 @@ func getCustomerBalanceInfo(t *testing.T, stub *mock.FullMockStub) []TransferEve
 	}
 
 	var transfers = []TransferEvent{}
-	err := json.Unmarshal(res.Payload, &transfers)
+	err := json.Unmarshal(res.Payload, &Page{Records: &transfers})
 	if err != nil {
 		t.Errorf("Failed to parse ballanceInfo: %s", err.Error())
 		t.FailNow()
@@ -196,7 +200,7 @@ func getShopClaims(t *testing.T, stub *mock.FullMockStub) []Asset {
 	}
 
 	var assets = []Asset{}
-	err := json.Unmarshal(res.Payload, &assets)
+	err := json.Unmarshal(res.Payload, &Page{Records: &assets})
 	if err != nil {
 		t.Errorf("Failed to parse Assets: %s", err.Error())
 		t.FailNow()
@@ -214,7 +218,7 @@ func getBankObligations(t *testing.T, stub *mock.FullMockStub) []BankObligation
 	}
 
 	var bankObligation = []BankObligation{}
-	err := json.Unmarshal(res.Payload, &bankObligation)
+	err := json.Unmarshal(res.Payload, &Page{Records: &bankObligation})
 	if err != nil {
 		t.Errorf("Failed to parse BankObligations: %s", err.Error())
 		t.FailNow()
@@ -232,7 +236,7 @@ func getCustomerAllowances(t *testing.T, stub *mock.FullMockStub) []AllowanceEve
 	}
 
 	var customerAllowances = []AllowanceEvent{}
-	err := json.Unmarshal(res.Payload, &customerAllowances)
+	err := json.Unmarshal(res.Payload, &Page{Records: &customerAllowances})
 	if err != nil {
 		t.Errorf("Failed to parse AllowanceEvent: %s", err.Error())
 		t.FailNow()
@@ -251,21 +255,21 @@ func TestCreateActors(t *testing.T) {
 	stub.MockCreator("default", testdata.TestUser1Cert)
 	createActors(t, stub, `[{"role": "customer", "name": "user1"}, {"role": "bank", "name": "bank1"}, {"role": "shop", "name": "shop1"}]`)
 
-	key, _ := stub.CreateCompositeKey(IndexCustomer, []string{"user1"})
+	key, _ := stub.CreateCompositeKey(IndexCustomer, []string{"default/user1"})
 	res, err := stub.GetState(key)
 	if err != nil || res == nil {
 		t.Errorf("Failed to create Customer: %s", "user1")
 		t.FailNow()
 	}
 
-	key, _ = stub.CreateCompositeKey(IndexBank, []string{"bank1"})
+	key, _ = stub.CreateCompositeKey(IndexBank, []string{"default/bank1"})
 	res, err = stub.GetState(key)
 	if err != nil || res == nil {
 		t.Errorf("Failed to create Bank: %s", "bank1")
 		t.FailNow()
 	}
 
-	key, _ = stub.CreateCompositeKey(IndexShop, []string{"shop1"})
+	key, _ = stub.CreateCompositeKey(IndexShop, []string{"default/shop1"})
 	res, err = stub.GetState(key)
 	if err != nil || res == nil {
 		t.Errorf("Failed to create Shop: %s", "shop1")
@@ -279,14 +283,14 @@ func TestProvideAsset(t *testing.T) {
 	createActors(t, stub, `[{"role": "customer", "name": "user1"}, {"role": "bank", "name": "testUser"}]`)
 	provideAsset(t, stub, `{"receiver": "user1", "value": 1000}`)
 
-	key, _ := stub.CreateCompositeKey(IndexCustomer, []string{"user1"})
+	key, _ := stub.CreateCompositeKey(IndexCustomer, []string{"default/user1"})
 	res, err := stub.GetState(key)
 	if err != nil || res == nil || binary.LittleEndian.Uint64(res) != 1000 {
 		t.Errorf("Failed to retrieve %s balance", "user1")
 		t.FailNow()
 	}
 
-	key, _ = stub.CreateCompositeKey(IndexBanksCustomers, []string{"testUser", "user1"})
+	key, _ = stub.CreateCompositeKey(IndexBanksCustomers, []string{"default/testUser", "default/user1"})
 	res, err = stub.GetState(key)
 	if err != nil || res == nil || binary.LittleEndian.Uint64(res) != 1000 {
 		t.Errorf("Failed to get balance of %s for Bank %s", "user1", "testUser")
@@ -305,8 +309,8 @@ func TestProvideAsset(t *testing.T) {
 		t.Errorf("Expected 1 but got %d bank customers", len(users))
 		t.FailNow()
 	}
-	if users[0].Name != "user1" {
-		t.Errorf("Expected name for bank customer user1 but received %s bank customers", users[0].Name)
+	if users[0].Name != "default/user1" {
+		t.Errorf("Expected name for bank customer default/user1 but received %s bank customers", users[0].Name)
 		t.FailNow()
 	}
 	if users[0].Balance != 1000 {
@@ -416,8 +420,8 @@ func TestBuyAndWithdraw(t *testing.T) {
 	}
 
 	bankObligations := getBankObligations(t, stub)
-	if len(bankObligations) != 4 {
-		t.Errorf("expected 4 but received %d" , len(bankObligations))
+	if len(bankObligations) != 5 {
+		t.Errorf("expected 5 but received %d" , len(bankObligations))
 		t.FailNow()
 	}
 	sum := uint64(0)
@@ -438,8 +442,8 @@ func TestBuyAndWithdraw(t *testing.T) {
 	}
 
 	assets := getShopClaims(t, stub)
-	if len(assets) != 4 {
-		t.Errorf("expected 6 but received %d" , len(assets))
+	if len(assets) != 5 {
+		t.Errorf("expected 5 but received %d" , len(assets))
 		t.FailNow()
 	}
 
@@ -459,7 +463,1821 @@ func TestBuyAndWithdraw(t *testing.T) {
 
 }
 
-func TestInitToken(t *testing.T) {
-	initToken(t)
+func TestMigrateAssetIds(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 300}`)
+
+	// an asset stored with the former random id scheme
+	stub.MockTransactionStart("legacy")
+	legacyKey, _ := stub.CreateCompositeKey(IndexCustomerAsset, []string{"testUser2", "testUser", "5577006791947779410"})
+	stub.PutState(legacyKey, []byte(`{"history":["testUser"],"value":200}`))
+	stub.MockTransactionEnd("legacy")
+
+	res := stub.MockInvoke("2", util.ToChaincodeArgs("migrateAssetIds"))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to migrateAssetIds: %s", res.Message)
+		t.FailNow()
+	}
+
+	if data, _ := stub.GetState(legacyKey); data != nil {
+		t.Errorf("legacy asset key was not removed")
+		t.FailNow()
+	}
+
+	migratedKey, _ := stub.CreateCompositeKey(IndexCustomerAsset, []string{"testUser2", "testUser", "2-0"})
+	data, _ := stub.GetState(migratedKey)
+	if data == nil {
+		t.Errorf("expected migrated asset under id 2-0")
+		t.FailNow()
+	}
+
+	asset := Asset{}
+	json.Unmarshal(data, &asset)
+	if asset.Value != 200 || len(asset.History) != 1 || asset.History[0] != "testUser" {
+		t.Errorf("migrated asset does not match legacy asset: %s", string(data))
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("3", util.ToChaincodeArgs("migrateAssetIds"))
+	if res.Status == shim.OK {
+		t.Errorf("expected second migration to fail")
+		t.FailNow()
+	}
+}
+
+func TestExpirePoints(t *testing.T) {
+	day := int64(24 * 60 * 60)
+	start := int64(1500000000)
+
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "customer", "name": "testUser"}, {"role": "shop", "name": "testUser3"}]`)
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("setExpiryPolicy", `{"validityDays": 30}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to setExpiryPolicy: %s", res.Message)
+		t.FailNow()
+	}
+
+	stub.MockTime(start)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 500}`)
+	stub.MockTime(start + 10 * day)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 200}`)
+
+	// the first gift is expired now
+	stub.MockTime(start + 35 * day)
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"receiver": "testUser", "value": 300}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected transfer of expired points to fail")
+		t.FailNow()
+	}
+	buy(t, stub, "testUser3", 100)
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("expirePoints"))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to expirePoints: %s", res.Message)
+		t.FailNow()
+	}
+
+	var sweep = ExpirySweep{}
+	json.Unmarshal(res.Payload, &sweep)
+	events := sweep.Expiries
+	if len(sweep.Customers) != 1 || sweep.Customers[0] != "default/testUser2" || len(events) != 1 || events[0].Customer != "default/testUser2" || events[0].Bank != "default/testUser" || events[0].Value != 500 {
+		t.Errorf("unexpected expiry events: %s", string(res.Payload))
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	userInfo := getCustomerBalance(t, stub)
+	if userInfo.Balance != 100 {
+		t.Errorf("expected 100 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 100)
+}
+
+func settlement(t *testing.T, stub *mock.FullMockStub, function string, body string) Settlement {
+	res := stub.MockInvoke("1", util.ToChaincodeArgs(function, body))
+
+	if res.Status != shim.OK {
+		t.Errorf("Failed to %s: %s", function, res.Message)
+		t.FailNow()
+	}
+
+	var settlement = Settlement{}
+	err := json.Unmarshal(res.Payload, &settlement)
+	if err != nil {
+		t.Errorf("Failed to parse Settlement: %s", err.Error())
+		t.FailNow()
+	}
+
+	return settlement
+}
+
+func TestSettlement(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 200}`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 300}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 400)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 400)
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	batch := settlement(t, stub, "openSettlement", `{"shop": "testUser3"}`)
+	if batch.Status != SettlementOpen || batch.Value != 400 || len(batch.Claims) != 2 {
+		t.Errorf("unexpected settlement %+v", batch)
+		t.FailNow()
+	}
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("openSettlement", `{"shop": "testUser3"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected claims to be part of one settlement only")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("confirmSettlement", `{"id": "` + batch.Id + `"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected confirmation without payment to fail")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	settlement(t, stub, "recordSettlementPayment", `{"id": "` + batch.Id + `", "paymentRef": "SWIFT-4711"}`)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	batch = settlement(t, stub, "confirmSettlement", `{"id": "` + batch.Id + `"}`)
+	if batch.Status != SettlementSettled || batch.PaymentRef != "SWIFT-4711" {
+		t.Errorf("unexpected settlement %+v", batch)
+		t.FailNow()
+	}
+
+	if obligations := getBankObligations(t, stub); len(obligations) != 0 {
+		t.Errorf("expected 0 but received %d", len(obligations))
+		t.FailNow()
+	}
+	if userInfo := getShopBalance(t, stub); userInfo.Balance != 0 {
+		t.Errorf("expected 0 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if claims := getShopClaims(t, stub); len(claims) != 0 {
+		t.Errorf("expected 0 but received %d", len(claims))
+		t.FailNow()
+	}
+	if userInfo := getBankBalance(t, stub); userInfo.Balance != 0 {
+		t.Errorf("expected 0 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+}
+
+func TestBurnBesideSettlement(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 500}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 400)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 100)
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	batch := settlement(t, stub, "openSettlement", `{"shop": "testUser3"}`)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 300)
+
+	// the burn takes the claim outside the batch on both sides
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res := stub.MockInvoke("2", util.ToChaincodeArgs("burn", `{"shop": "testUser3", "value": 300, "reason": "WRITE_OFF"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to burn: %s", res.Message)
+		t.FailNow()
+	}
+
+	var shopAssets []Asset
+	iterator, _ := stub.GetStateByPartialCompositeKey(IndexShopAsset, []string{"default/testUser3"})
+	for iterator.HasNext() {
+		kv, _ := iterator.Next()
+		asset := Asset{}
+		json.Unmarshal(kv.Value, &asset)
+		shopAssets = append(shopAssets, asset)
+	}
+	iterator.Close()
+	if len(shopAssets) != 1 || shopAssets[0].Value != 100 || shopAssets[0].Claim != batch.Claims[0].Id {
+		t.Errorf("expected the shop side of the batched claim to remain, received %+v", shopAssets)
+		t.FailNow()
+	}
+
+	// the shop side of a batched claim can't be refunded either
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("refund", `{"buyer": "testUser2", "value": 50}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected refund of a batched claim to fail")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	settlement(t, stub, "recordSettlementPayment", `{"id": "` + batch.Id + `", "paymentRef": "SWIFT-4711"}`)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	settlement(t, stub, "confirmSettlement", `{"id": "` + batch.Id + `"}`)
+
+	if obligations := getBankObligations(t, stub); len(obligations) != 0 {
+		t.Errorf("expected 0 but received %d", len(obligations))
+		t.FailNow()
+	}
+}
+
+func TestComputeNetting(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	// testUser and testUser3 both act as bank and as shop
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "shop", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "bank", "name": "testUser3"}, {"role": "shop", "name": "testUser3"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 500}`)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 300}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 500)
+	buy(t, stub, "testUser", 300)
+
+	stub.MockTime(2000)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 500)
+	stub.MockTime(3000)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	withdrawFromUser(t, stub, "testUser2", 300)
+
+	res := stub.MockInvoke("2", util.ToChaincodeArgs("computeNetting", `{"cutOff": 2500}`))
+	report := NettingReport{}
+	json.Unmarshal(res.Payload, &report)
+	if res.Status != shim.OK || report.Claims != 1 || report.Scope != NettingBankClaims {
+		t.Errorf("expected 1 claim before the cut-off but received %s", string(res.Payload))
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("computeNetting"))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to computeNetting: %s", res.Message)
+		t.FailNow()
+	}
+
+	report = NettingReport{}
+	json.Unmarshal(res.Payload, &report)
+	if report.Claims != 2 || len(report.Gross) != 2 {
+		t.Errorf("expected 2 gross claims but received %s", string(res.Payload))
+		t.FailNow()
+	}
+	if len(report.Net) != 1 || report.Net[0].Payer != "default/testUser" || report.Net[0].Payee != "default/testUser3" || report.Net[0].Value != 200 {
+		t.Errorf("unexpected net obligations %+v", report.Net)
+		t.FailNow()
+	}
+	if len(report.Positions) != 2 || report.Positions[0].NetPayable != 200 || report.Positions[1].NetReceivable != 200 {
+		t.Errorf("unexpected positions %+v", report.Positions)
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getNettingReport", `{"id": "` + report.Id + `"}`))
+	stored := NettingReport{}
+	json.Unmarshal(res.Payload, &stored)
+	if res.Status != shim.OK || stored.Id != report.Id || len(stored.Net) != 1 {
+		t.Errorf("Failed to getNettingReport: %s", res.Message)
+		t.FailNow()
+	}
+}
+
+func TestSpendStrategy(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "bank", "name": "testUser3"}, {"role": "customer", "name": "testUser"}, {"role": "customer", "name": "testUser2"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 100}`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 200}`)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 500}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"receiver": "testUser", "value": 400, "strategy": "largest"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to transfer: %s", res.Message)
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"receiver": "testUser", "value": 100, "strategy": "bank", "preferBank": "testUser"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to transfer: %s", res.Message)
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"receiver": "testUser", "value": 100, "strategy": "random"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected unknown strategy to fail")
+		t.FailNow()
+	}
+
+	perBank := map[string]uint64{}
+	for _, transfer := range getCustomerBalanceInfo(t, stub) {
+		perBank[transfer.Sender] += transfer.Value
+	}
+	if perBank["default/testUser3"] != 100 || perBank["default/testUser"] != 200 {
+		t.Errorf("unexpected remaining points per bank %v", perBank)
+		t.FailNow()
+	}
+}
+
+func TestCancelRedemption(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 1000}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 600)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 200)
+
+	// the shop gives back a part
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("cancelRedemption", `{"buyer": "testUser2", "value": 100}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to cancelRedemption: %s", res.Message)
+		t.FailNow()
+	}
+
+	// 200 are withdrawn already
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("cancelRedemption", `{"shop": "testUser3", "value": 400}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected cancellation of withdrawn points to fail")
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("cancelRedemption", `{"shop": "testUser3"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to cancelRedemption: %s", res.Message)
+		t.FailNow()
+	}
+
+	userInfo := getCustomerBalance(t, stub)
+	if userInfo.Balance != 800 {
+		t.Errorf("expected 800 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	allowances := getCustomerAllowances(t, stub)
+	if len(allowances) != 1 || allowances[0].Value != 0 {
+		t.Errorf("expected an empty allowance but received %+v", allowances)
+		t.FailNow()
+	}
+}
+
+func TestReleaseExpiredAllowances(t *testing.T) {
+	day := int64(24 * 60 * 60)
+	start := int64(1500000000)
+
+	stub := initToken(t)
+	stub.MockTime(start)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}, {"role": "shop", "name": "testUser"}, {"role": "shop", "name": "testShop"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 1000}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	for _, redemption := range []string{`{"receiver": "testUser3", "value": 300`, `{"receiver": "testShop", "value": 100`} {
+		res := stub.MockInvoke("1", util.ToChaincodeArgs("redeem", redemption + `, "deadline": ` + strconv.FormatInt(start + day, 10) + `}`))
+		if res.Status != shim.OK {
+			t.Errorf("Failed to redeem: %s", res.Message)
+			t.FailNow()
+		}
+	}
+	buy(t, stub, "testUser", 200)
+
+	allowances := getCustomerAllowances(t, stub)
+	if len(allowances) != 3 || allowances[2].Deadline != start + day {
+		t.Errorf("expected deadline %d but received %+v", start + day, allowances)
+		t.FailNow()
+	}
+
+	// the deadline second itself is expired, like the expiry of points
+	stub.MockTime(start + day)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("withdraw", `{"buyer": "testUser2", "value": 300}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected withdraw at the deadline to fail")
+		t.FailNow()
+	}
+
+	stub.MockTime(start + 2 * day)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("withdraw", `{"buyer": "testUser2", "value": 300}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected withdraw after the deadline to fail")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("releaseExpiredAllowances"))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to releaseExpiredAllowances: %s", res.Message)
+		t.FailNow()
+	}
+
+	userInfo := getCustomerBalance(t, stub)
+	if userInfo.Balance != 800 {
+		t.Errorf("expected 800 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	// both expired allowances are credited at once
+	entries := getLedger(t, stub, `{"from": ` + strconv.FormatInt(start + 2 * day, 10) + `}`)
+	if len(entries) != 1 || entries[0].Type != LedgerRelease || entries[0].Amount != 400 || entries[0].Counterparty != "" || entries[0].Balance != 800 {
+		t.Errorf("expected a single release of 400 but received %+v", entries)
+		t.FailNow()
+	}
+
+	// the allowance without deadline stays
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	withdrawFromUser(t, stub, "testUser2", 200)
+}
+
+func TestRefund(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 300}`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 300}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 500)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 500)
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("refund", `{"buyer": "testUser2", "value": 600}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected refund of more than withdrawn to fail")
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("refund", `{"buyer": "testUser2", "value": 400}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to refund: %s", res.Message)
+		t.FailNow()
+	}
+
+	if userInfo := getShopBalance(t, stub); userInfo.Balance != 100 {
+		t.Errorf("expected 100 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if userInfo := getBankBalance(t, stub); userInfo.Balance != 100 {
+		t.Errorf("expected 100 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	sum := uint64(0)
+	for _, claim := range getShopClaims(t, stub) {
+		sum += claim.Value
+	}
+	if sum != 100 {
+		t.Errorf("expected claims of 100 but received %d", sum)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if userInfo := getCustomerBalance(t, stub); userInfo.Balance != 500 {
+		t.Errorf("expected 500 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	refunded := 0
+	for _, transfer := range getCustomerBalanceInfo(t, stub) {
+		if transfer.Sender == "default/testUser3" {
+			refunded += int(transfer.Value)
+		}
+	}
+	if refunded != 400 {
+		t.Errorf("expected 400 refunded but received %d", refunded)
+		t.FailNow()
+	}
+
+	// refunded points can be spent again
+	buy(t, stub, "testUser3", 500)
+}
+
+func TestClawbackAndBurn(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "bank", "name": "testUser3"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 500}`)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 300}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 200)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 200)
+
+	// only the remaining 300 of the first bank can be taken back
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res := stub.MockInvoke("2", util.ToChaincodeArgs("clawback", `{"customer": "testUser2", "value": 1000, "reason": "MISTAKE"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to clawback: %s", res.Message)
+		t.FailNow()
+	}
+
+	retirement := Retirement{}
+	json.Unmarshal(res.Payload, &retirement)
+	if retirement.Value != 300 || retirement.Reason != "MISTAKE" {
+		t.Errorf("unexpected clawback %+v", retirement)
+		t.FailNow()
+	}
+
+	users := getMyCustomerList(t, stub)
+	if len(users) != 1 || users[0].Balance != 200 {
+		t.Errorf("expected bank customer balance 200 but received %+v", users)
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("3", util.ToChaincodeArgs("burn", `{"shop": "testUser3", "value": 150, "reason": "WRITE_OFF"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to burn: %s", res.Message)
+		t.FailNow()
+	}
+
+	if userInfo := getBankBalance(t, stub); userInfo.Balance != 50 {
+		t.Errorf("expected 50 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getRetirements"))
+	var retirements = []Retirement{}
+	json.Unmarshal(res.Payload, &retirements)
+	if len(retirements) != 2 {
+		t.Errorf("expected 2 but received %d", len(retirements))
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if userInfo := getCustomerBalance(t, stub); userInfo.Balance != 300 {
+		t.Errorf("expected 300 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	if userInfo := getShopBalance(t, stub); userInfo.Balance != 50 {
+		t.Errorf("expected 50 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+}
+
+func changeAdmins(t *testing.T, stub *mock.FullMockStub, uuid string, function string, body string) {
+	res := stub.MockInvoke(uuid, util.ToChaincodeArgs(function, body))
+
+	if res.Status != shim.OK {
+		t.Errorf("Failed to %s: %s", function, res.Message)
+		t.FailNow()
+	}
+}
+
+func TestAdminRotation(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res := stub.MockInvoke("a0", util.ToChaincodeArgs("addAdmin", `{"cn": "testUser2"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected admin without MSP to be rejected")
+		t.FailNow()
+	}
+
+	// the CN of an admin issued by another MSP is no admin
+	stub.MockCreator("evilMSP", testdata.TestUser1Cert)
+	res = stub.MockInvoke("a0", util.ToChaincodeArgs("addAdmin", `{"mspId": "evilMSP", "cn": "testUser2"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected admin CN of another MSP to be rejected")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	changeAdmins(t, stub, "a1", "addAdmin", `{"mspId": "default", "cn": "testUser2"}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	changeAdmins(t, stub, "a2", "removeAdmin", `{"mspId": "default", "cn": "testUser"}`)
+
+	res = stub.MockInvoke("a3", util.ToChaincodeArgs("removeAdmin", `{"mspId": "default", "cn": "testUser2"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected removal of the last admin to fail")
+		t.FailNow()
+	}
+
+	changeAdmins(t, stub, "a4", "rotateAdmin", `{"admin": {"mspId": "default", "cn": "testUser2"}, "new": {"mspId": "default", "cn": "testUser3"}}`)
+
+	for _, cert := range []string{testdata.TestUser1Cert, testdata.TestUser2Cert} {
+		stub.MockCreator("default", cert)
+		res = stub.MockInvoke("1", util.ToChaincodeArgs("createActors", `[{"role": "customer", "name": "user1"}]`))
+		if res.Status == shim.OK {
+			t.Errorf("expected former admin to be rejected")
+			t.FailNow()
+		}
+	}
+
+	// admins are bound to their MSP
+	stub.MockCreator("otherMSP", testdata.TestUser3Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("createActors", `[{"role": "customer", "name": "user1"}]`))
+	if res.Status == shim.OK {
+		t.Errorf("expected admin of another MSP to be rejected")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	createActors(t, stub, `[{"role": "customer", "name": "user1"}]`)
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getAdminAudit"))
+	var audit = []AdminAuditEntry{}
+	json.Unmarshal(res.Payload, &audit)
+	if len(audit) != 3 || audit[0].Action != "add" || audit[0].By.MspId != "default" || audit[1].Action != "remove" || audit[2].Action != "rotate" || audit[2].New.CN != "testUser3" {
+		t.Errorf("unexpected admin audit %s", string(res.Payload))
+		t.FailNow()
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "user1", "mspId": "orgA"}, {"role": "customer", "name": "orgB/user1"}]`)
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("provideAsset", `{"receiver": "user1", "value": 100}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected ambiguous receiver to fail")
+		t.FailNow()
+	}
+	provideAsset(t, stub, `{"receiver": "orgA/user1", "value": 100}`)
+
+	key, _ := stub.CreateCompositeKey(IndexCustomer, []string{"orgA/user1"})
+	if data, _ := stub.GetState(key); data == nil || binary.LittleEndian.Uint64(data) != 100 {
+		t.Errorf("expected 100 for orgA/user1")
+		t.FailNow()
+	}
+	key, _ = stub.CreateCompositeKey(IndexCustomer, []string{"orgB/user1"})
+	if data, _ := stub.GetState(key); data == nil || binary.LittleEndian.Uint64(data) != 0 {
+		t.Errorf("expected 0 for orgB/user1")
+		t.FailNow()
+	}
+
+	// a customer and an asset stored with CN-only names
+	stub.MockTransactionStart("legacy")
+	legacyCustomer, _ := stub.CreateCompositeKey(IndexCustomer, []string{"user2"})
+	stub.PutState(legacyCustomer, []byte{50, 0, 0, 0, 0, 0, 0, 0})
+	legacyAsset, _ := stub.CreateCompositeKey(IndexCustomerAsset, []string{"user2", "oldBank", "1-0"})
+	stub.PutState(legacyAsset, []byte(`{"history":["oldBank"],"value":50}`))
+	stub.PutState(KeySettings, []byte(`{"admins": [{"mspId": "default", "cn": "testUser"}], "admin": "testUser2"}`))
+	stub.MockTransactionEnd("legacy")
+
+	// the CN-only admin of former settings has no rights before it is bound
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("createActors", `[{"role": "customer", "name": "user3"}]`))
+	if res.Status == shim.OK {
+		t.Errorf("expected the unbound legacy admin to be rejected")
+		t.FailNow()
+	}
+	stub.MockCreator("default", testdata.TestUser1Cert)
+
+	res = stub.MockInvoke("2", util.ToChaincodeArgs("migrateIdentities", `{"defaultMspId": "default", "mspIds": {"oldBank": "orgB"}}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to migrateIdentities: %s", res.Message)
+		t.FailNow()
+	}
+
+	// the legacy admin is bound to the default MSP the migration names
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("info"))
+	migrated := Settings{}
+	json.Unmarshal(res.Payload, &migrated)
+	if migrated.Admin != "" || len(migrated.Admins) != 2 || migrated.Admins[1] != (AdminIdentity{"default", "testUser2"}) {
+		t.Errorf("expected the legacy admin to be bound but received %s", string(res.Payload))
+		t.FailNow()
+	}
+
+	if data, _ := stub.GetState(legacyAsset); data != nil {
+		t.Errorf("legacy asset key was not removed")
+		t.FailNow()
+	}
+	migratedAsset, _ := stub.CreateCompositeKey(IndexCustomerAsset, []string{"default/user2", "orgB/oldBank", "1-0"})
+	asset := Asset{}
+	data, _ := stub.GetState(migratedAsset)
+	json.Unmarshal(data, &asset)
+	if asset.Value != 50 || len(asset.History) != 1 || asset.History[0] != "orgB/oldBank" {
+		t.Errorf("migrated asset does not match legacy asset: %s", string(data))
+		t.FailNow()
+	}
+
+	// the migrated customer is known by its CN again
+	provideAsset(t, stub, `{"receiver": "user2", "value": 10}`)
+	migratedCustomer, _ := stub.CreateCompositeKey(IndexCustomer, []string{"default/user2"})
+	if data, _ := stub.GetState(migratedCustomer); data == nil || binary.LittleEndian.Uint64(data) != 60 {
+		t.Errorf("expected 60 for default/user2")
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("3", util.ToChaincodeArgs("migrateIdentities", `{"defaultMspId": "default"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected second migration to fail")
+		t.FailNow()
+	}
+}
+
+func TestRegister(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}]`)
+
+	// without a role attribute
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("register"))
+	if res.Status == shim.OK {
+		t.Errorf("expected register without role attribute to fail")
+		t.FailNow()
+	}
+
+	// shops and banks wait for an admin
+	stub.MockCreator("default", testdata.TestShopCert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("register"))
+	if res.Status != shim.OK || actorExists(stub, "default/testShop", "shop") {
+		t.Errorf("expected pending shop registration: %s", res.Message)
+		t.FailNow()
+	}
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("register"))
+	if res.Status == shim.OK {
+		t.Errorf("expected second registration to fail")
+		t.FailNow()
+	}
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("approveRegistration", `{"role": "shop", "id": "default/testShop"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected approval by the registrant to fail")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("approveRegistration", `{"role": "shop", "id": "default/testShop"}`))
+	if res.Status != shim.OK || !actorExists(stub, "default/testShop", "shop") {
+		t.Errorf("Failed to approve shop: %s", res.Message)
+		t.FailNow()
+	}
+
+	st, _ := json.Marshal(Settings{Admins: settings.Admins, CustomerApproval: true})
+	stub.MockInit("2", util.ToChaincodeArgs("init", string(st)))
+
+	stub.MockCreator("default", testdata.TestCustomerCert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("register", `{"bank": "testUser"}`))
+	if res.Status != shim.OK || actorExists(stub, "default/testCustomer", "customer") {
+		t.Errorf("expected pending registration: %s", res.Message)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	var registrations = []Registration{}
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getRegistrations"))
+	json.Unmarshal(res.Payload, &registrations)
+	if len(registrations) != 1 || registrations[0].Customer != "default/testCustomer" {
+		t.Errorf("unexpected registrations: %s", string(res.Payload))
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("approveRegistration", `{"customer": "default/testCustomer"}`))
+	if res.Status != shim.OK || !actorExists(stub, "default/testCustomer", "customer") {
+		t.Errorf("Failed to approveRegistration: %s", res.Message)
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getRegistrations"))
+	json.Unmarshal(res.Payload, &registrations)
+	if len(registrations) != 0 {
+		t.Errorf("expected no pending registrations: %s", string(res.Payload))
+		t.FailNow()
+	}
+}
+
+func TestActorRegistry(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser", "metadata": {"city": "Bern"}}, {"role": "customer", "name": "testUser2"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 100}`)
+
+	// re-creating an actor must not reset its balance
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("createActors", `[{"role": "customer", "name": "testUser2"}]`))
+	if res.Status == shim.OK {
+		t.Errorf("expected duplicate actor to fail")
+		t.FailNow()
+	}
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if userInfo := getCustomerBalance(t, stub); userInfo.Balance != 100 {
+		t.Errorf("expected 100 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("createActors", `[{"role": "merchant", "name": "testUser3"}]`))
+	if res.Status == shim.OK {
+		t.Errorf("expected unknown role to fail")
+		t.FailNow()
+	}
+
+	actor := Actor{}
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getActor"))
+	json.Unmarshal(res.Payload, &actor)
+	if len(actor.Roles) != 2 || actor.Roles[0] != "bank" || actor.Roles[1] != "customer" || actor.Status != ActorActive || actor.Metadata["city"] != "Bern" {
+		t.Errorf("unexpected actor: %s", string(res.Payload))
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("updateActor", `{"id": "testUser", "metadata": {"city": "Basel"}}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected update of another actor to fail")
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("updateActor", `{"metadata": {"displayName": "Test User 2"}}`))
+	json.Unmarshal(res.Payload, &actor)
+	if res.Status != shim.OK || actor.Id != "default/testUser2" || actor.Metadata["displayName"] != "Test User 2" {
+		t.Errorf("Failed to updateActor: %s %s", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+
+	// an actor record which can't be read is never replaced by a fresh one
+	stub.MockTransactionStart("broken")
+	key, _ := stub.CreateCompositeKey(IndexActor, []string{"default/testUser2"})
+	stub.PutState(key, []byte("{"))
+	stub.MockTransactionEnd("broken")
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("createActors", `[{"role": "shop", "name": "testUser2"}]`))
+	if res.Status == shim.OK {
+		t.Errorf("expected creating a role of an unreadable actor to fail")
+		t.FailNow()
+	}
+	if data, _ := stub.GetState(key); string(data) != "{" {
+		t.Errorf("unreadable actor record was overwritten: %s", string(data))
+		t.FailNow()
+	}
+}
+
+func listActors(t *testing.T, stub *mock.FullMockStub, function string, body string) ActorPage {
+	res := stub.MockInvoke("1", util.ToChaincodeArgs(function, body))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to %s: %s", function, res.Message)
+		t.FailNow()
+	}
+
+	page := ActorPage{}
+	json.Unmarshal(res.Payload, &page)
+	return page
+}
+
+func TestActorDirectory(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "bank", "name": "testUser3"}, {"role": "shop", "name": "shop1", "metadata": {"city": "Bern"}}, {"role": "shop", "name": "shop2"}, {"role": "customer", "name": "testUser2"}]`)
+
+	if page := listActors(t, stub, "listActors", `{}`); page.Count != 5 || page.Bookmark != "" {
+		t.Errorf("expected 5 actors for the admin but received %+v", page)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	shops := listActors(t, stub, "getShops", `{"metadata": true}`)
+	if shops.Count != 2 || shops.Records[0].Id != "default/shop1" || shops.Records[0].Metadata["city"] != "Bern" {
+		t.Errorf("unexpected shops %+v", shops)
+		t.FailNow()
+	}
+
+	// customers see banks and shops only
+	for _, function := range []string{"getCustomersNames", "listActors"} {
+		res := stub.MockInvoke("1", util.ToChaincodeArgs(function, `{"role": "customer"}`))
+		if res.Status == shim.OK {
+			t.Errorf("expected %s of customers to fail for a customer", function)
+			t.FailNow()
+		}
+	}
+
+	first := listActors(t, stub, "listActors", `{"pageSize": 3}`)
+	if first.Count != 3 || first.Bookmark == "" || first.Records[0].Role != "bank" || first.Records[2].Role != "shop" {
+		t.Errorf("unexpected first page %+v", first)
+		t.FailNow()
+	}
+	next, _ := json.Marshal(PageQuery{PageSize: 3, Bookmark: first.Bookmark})
+	second := listActors(t, stub, "listActors", string(next))
+	if second.Count != 1 || second.Bookmark != "" || second.Records[0].Id != "default/shop2" {
+		t.Errorf("unexpected second page %+v", second)
+		t.FailNow()
+	}
+
+	// a page ending with the last bank continues with the shops
+	first = listActors(t, stub, "listActors", `{"pageSize": 2}`)
+	if first.Count != 2 || first.Bookmark != "shop:" {
+		t.Errorf("unexpected page of banks %+v", first)
+		t.FailNow()
+	}
+	next, _ = json.Marshal(PageQuery{PageSize: 2, Bookmark: first.Bookmark})
+	second = listActors(t, stub, "listActors", string(next))
+	if second.Count != 2 || second.Bookmark != "" || second.Records[0].Id != "default/shop1" {
+		t.Errorf("unexpected page of shops %+v", second)
+		t.FailNow()
+	}
+
+	// closed actors leave the directory, the others are listed with their status
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("closeAccount", `{"reason": "LEAVING"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to closeAccount: %s", res.Message)
+		t.FailNow()
+	}
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if page := listActors(t, stub, "listActors", `{}`); page.Count != 4 || page.Records[3].Id != "default/shop2" || page.Records[3].Status != ActorActive {
+		t.Errorf("expected 4 listed actors but received %+v", page)
+		t.FailNow()
+	}
+
+	// an actor record which can't be read fails the listing
+	stub.MockTransactionStart("broken")
+	key, _ := stub.CreateCompositeKey(IndexActor, []string{"default/shop1"})
+	stub.PutState(key, []byte("{"))
+	stub.MockTransactionEnd("broken")
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getShops", `{"metadata": true}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected listing of an unreadable actor to fail")
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("listActors", `{"bookmark": "bad"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected a bad bookmark to fail")
+		t.FailNow()
+	}
+}
+
+func TestActorProfile(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "shop", "name": "testUser3", "profile": {"displayName": "Shop Three", "category": "5411", "country": "CH"}}]`)
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("createActors", `[{"role": "customer", "name": "testUser2", "profile": {"category": "5411"}}]`))
+	if res.Status == shim.OK {
+		t.Errorf("expected category of a customer to fail")
+		t.FailNow()
+	}
+
+	shops := listActors(t, stub, "getShops", `{"metadata": true}`)
+	if shops.Count != 1 || shops.Records[0].Profile == nil || shops.Records[0].Profile.DisplayName != "Shop Three" {
+		t.Errorf("unexpected shops %+v", shops)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("updateActor", `{"profile": {"logoUrl": "ftp://shop3.ch/logo.png"}}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected logoUrl without http(s) to fail")
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("updateActor", `{"profile": {"contact": "support@shop3.ch"}}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to updateActor: %s", res.Message)
+		t.FailNow()
+	}
+
+	profile := getShopBalance(t, stub).Profile
+	if profile == nil || profile.DisplayName != "Shop Three" || profile.Contact != "support@shop3.ch" || profile.Category != "5411" {
+		t.Errorf("unexpected profile %+v", profile)
+		t.FailNow()
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 100}`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 50}`)
+
+	// the disputed fragment of 100
+	disputed := ""
+	iterator, _ := stub.GetStateByPartialCompositeKey(IndexCustomerAsset, []string{"default/testUser2"})
+	for iterator.HasNext() {
+		kv, _ := iterator.Next()
+		asset := Asset{}
+		json.Unmarshal(kv.Value, &asset)
+		if asset.Value == 100 {
+			_, parts, _ := stub.SplitCompositeKey(kv.Key)
+			disputed = parts[2]
+		}
+	}
+	iterator.Close()
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("freezeFragment", `{"customer": "testUser2", "id": "` + disputed + `", "reason": "DISPUTE"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to freezeFragment: %s", res.Message)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("redeem", `{"receiver": "testUser3", "value": 60}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected redeem of frozen points to fail")
+		t.FailNow()
+	}
+	buy(t, stub, "testUser3", 50)
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("freezeAccount", `{"id": "testUser2", "reason": "FRAUD"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to freezeAccount: %s", res.Message)
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("provideAsset", `{"receiver": "testUser2", "value": 10}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected provideAsset to a suspended account to fail")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("cancelRedemption", `{"shop": "testUser3"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected cancelRedemption of a suspended account to fail")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("unfreezeAccount", `{"id": "testUser2", "reason": "CLEARED"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to unfreezeAccount: %s", res.Message)
+		t.FailNow()
+	}
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("unfreezeFragment", `{"customer": "testUser2", "id": "` + disputed + `"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to unfreezeFragment: %s", res.Message)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 100)
+
+	// an actor record which can't be read doesn't let the caller through
+	stub.MockTransactionStart("broken")
+	key, _ := stub.CreateCompositeKey(IndexActor, []string{"default/testUser2"})
+	stub.PutState(key, []byte("{"))
+	stub.MockTransactionEnd("broken")
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("redeem", `{"receiver": "testUser3", "value": 100}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected redeem with an unreadable actor record to fail")
+		t.FailNow()
+	}
+}
+
+func TestCloseAccount(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "bank", "name": "testUser3"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testShop"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 100}`)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 50}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testShop", 30)
+	buy(t, stub, "testShop", 20)
+	stub.MockCreator("default", testdata.TestShopCert)
+	withdrawFromUser(t, stub, "testUser2", 20)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("closeAccount", `{"reason": "LEAVING"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to closeAccount: %s", res.Message)
+		t.FailNow()
+	}
+
+	var retirements = []Retirement{}
+	json.Unmarshal(res.Payload, &retirements)
+	perBank := map[string]uint64{}
+	for _, retirement := range retirements {
+		perBank[retirement.Bank] += retirement.Value
+	}
+	if len(retirements) != 2 || perBank["default/testUser"] != 80 || perBank["default/testUser3"] != 50 {
+		t.Errorf("unexpected closure %s", string(res.Payload))
+		t.FailNow()
+	}
+
+	if userInfo := getCustomerBalance(t, stub); userInfo.Balance != 0 {
+		t.Errorf("expected 0 but received %d", userInfo.Balance)
+		t.FailNow()
+	}
+	for _, allowance := range getCustomerAllowances(t, stub) {
+		if allowance.Value != 0 {
+			t.Errorf("expected cancelled allowances but received %+v", allowance)
+			t.FailNow()
+		}
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	// only the points withdrawn by the shop stay provided to the closed account
+	if customers := getMyCustomerList(t, stub); len(customers) != 1 || customers[0].Balance != 20 {
+		t.Errorf("expected only the withdrawn points provided to the closed account")
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("provideAsset", `{"receiver": "testUser2", "value": 10}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected provideAsset to a closed account to fail")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestShopCert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("refund", `{"buyer": "testUser2", "value": 10}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected refund to a closed account to fail")
+		t.FailNow()
+	}
+}
+
+func TestOffboardBank(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "shop", "name": "testUser"}, {"role": "bank", "name": "testUser3"}, {"role": "customer", "name": "testUser2"}]`)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 100}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser", 40)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	withdrawFromUser(t, stub, "testUser2", 40)
+
+	offboarding := `{"bank": "testUser3", "mode": "transfer", "successor": "testUser", "reason": "MERGER"}`
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("offboardBank", offboarding))
+	if res.Status == shim.OK {
+		t.Errorf("expected offboarding with unsettled claims to fail")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res = stub.MockInvoke("2", util.ToChaincodeArgs("burn", `{"shop": "testUser", "value": 40, "reason": "SETTLED_OFF_CHAIN"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to burn: %s", res.Message)
+		t.FailNow()
+	}
+
+	// counts in the request don't add to the result
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("3", util.ToChaincodeArgs("offboardBank", `{"bank": "testUser3", "mode": "transfer", "successor": "testUser", "reason": "MERGER", "fragments": 1000, "value": 100}`))
+	result := BankOffboarding{}
+	json.Unmarshal(res.Payload, &result)
+	if res.Status != shim.OK || result.Fragments != 1 || result.Value != 60 {
+		t.Errorf("Failed to offboardBank: %s %s", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+
+	iterator, _ := stub.GetStateByPartialCompositeKey(IndexCustomerAsset, []string{"default/testUser2"})
+	for iterator.HasNext() {
+		kv, _ := iterator.Next()
+		asset := Asset{}
+		json.Unmarshal(kv.Value, &asset)
+		if asset.History[0] != "default/testUser" || len(asset.Migrations) != 1 || asset.Migrations[0].From != "default/testUser3" {
+			t.Errorf("unexpected provenance of migrated fragment: %s", string(kv.Value))
+			t.FailNow()
+		}
+	}
+	iterator.Close()
+
+	if customers := getMyCustomerList(t, stub); len(customers) != 1 || customers[0].Balance != 100 {
+		t.Errorf("expected the customer of the former bank, received %+v", customers)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res = stub.MockInvoke("4", util.ToChaincodeArgs("provideAsset", `{"receiver": "testUser2", "value": 10}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected provideAsset of an offboarded bank to fail")
+		t.FailNow()
+	}
+}
+
+func TestIssuanceQuota(t *testing.T) {
+	stub := initToken(t)
+	stub.MockTime(1000)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("setIssuanceQuota", `{"bank": "testUser", "outstandingCap": 500, "periodCap": 300, "periodDays": 1}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to setIssuanceQuota: %s", res.Message)
+		t.FailNow()
+	}
+
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 200}`)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("provideAsset", `{"receiver": "testUser2", "value": 150}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected period cap to be enforced")
+		t.FailNow()
+	}
+
+	stub.MockTime(1000 + secondsPerDay)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 150}`)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("provideAsset", `{"receiver": "testUser2", "value": 200}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected outstanding cap to be enforced")
+		t.FailNow()
+	}
+
+	// withdrawn points are no longer outstanding
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 100)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 100)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 150}`)
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getIssuanceQuota"))
+	status := QuotaStatus{}
+	json.Unmarshal(res.Payload, &status)
+	if res.Status != shim.OK || status.Outstanding != 400 || status.PeriodIssued != 300 || status.Headroom == nil || *status.Headroom != 0 {
+		t.Errorf("unexpected quota status %s %s", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("setIssuanceQuota", `{"bank": "testUser", "outstandingCap": 5000}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected setIssuanceQuota of a non admin to fail")
+		t.FailNow()
+	}
+}
+
+func getBankLiability(t *testing.T, stub *mock.FullMockStub, body string) BankLiability {
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("getBankLiability", body))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to getBankLiability: %s", res.Message)
+		t.FailNow()
+	}
+
+	liability := BankLiability{}
+	json.Unmarshal(res.Payload, &liability)
+	return liability
+}
+
+func TestBankLiability(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 300}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 100)
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	liability := getBankLiability(t, stub, `{"bank": "testUser"}`)
+	if liability.Issued != 300 || liability.Outstanding != 200 || liability.PendingRedemption != 100 || liability.Claimed != 0 {
+		t.Errorf("unexpected liability after redeem %+v", liability)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 60)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("cancelRedemption", `{"shop": "testUser3"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to cancelRedemption: %s", res.Message)
+		t.FailNow()
+	}
+
+	// without bank the admin gets the total supply
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	liability = getBankLiability(t, stub, `{}`)
+	if liability.Issued != 300 || liability.Outstanding != 240 || liability.PendingRedemption != 0 || liability.Claimed != 60 {
+		t.Errorf("unexpected total supply %+v", liability)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getBankLiability", `{"bank": "testUser"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected getBankLiability of another bank to fail")
+		t.FailNow()
+	}
+
+	// a counter which would fall below 0 fails the transaction instead of stopping at 0
+	stub.MockTransactionStart("broken")
+	key, _ := stub.CreateCompositeKey(IndexBankLiability, []string{"default/testUser"})
+	stub.PutState(key, []byte(`{"issued":300,"outstanding":10,"claimed":60}`))
+	stub.MockTransactionEnd("broken")
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("redeem", `{"receiver": "testUser3", "value": 20}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected redeem beyond the outstanding counter to fail")
+		t.FailNow()
+	}
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if liability = getBankLiability(t, stub, `{"bank": "testUser"}`); liability.Outstanding != 10 || liability.PendingRedemption != 0 {
+		t.Errorf("expected the liability to stay unchanged %+v", liability)
+		t.FailNow()
+	}
+}
+
+func TestPendingAfterClawback(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "bank", "name": "testShop"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 100}`)
+	stub.MockCreator("default", testdata.TestShopCert)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 100}`)
+
+	// the redemption is booked on the points of testShop, which are spent first
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 100)
+
+	stub.MockCreator("default", testdata.TestShopCert)
+	if liability := getBankLiability(t, stub, `{}`); liability.PendingRedemption != 100 {
+		t.Errorf("expected the redemption on testShop %+v", liability)
+		t.FailNow()
+	}
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("clawback", `{"customer": "testUser2", "value": 100, "reason": "FRAUD"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to clawback: %s", res.Message)
+		t.FailNow()
+	}
+
+	// the remaining points of testUser now cover the redemption
+	if liability := getBankLiability(t, stub, `{}`); liability.Outstanding != 0 || liability.PendingRedemption != 0 {
+		t.Errorf("unexpected liability of testShop %+v", liability)
+		t.FailNow()
+	}
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if liability := getBankLiability(t, stub, `{"bank": "testUser"}`); liability.Outstanding != 0 || liability.PendingRedemption != 100 {
+		t.Errorf("unexpected liability of testUser %+v", liability)
+		t.FailNow()
+	}
+	if report := auditInvariants(t, stub); len(report.Discrepancies) != 0 {
+		t.Errorf("unexpected discrepancies %+v", report.Discrepancies)
+		t.FailNow()
+	}
+}
+
+func auditInvariants(t *testing.T, stub *mock.FullMockStub) AuditReport {
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("auditInvariants"))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to auditInvariants: %s", res.Message)
+		t.FailNow()
+	}
+
+	report := AuditReport{}
+	json.Unmarshal(res.Payload, &report)
+	return report
+}
+
+func TestAuditInvariants(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}, {"role": "customer", "name": "testUser4"}]`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 1000}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	transferUserToUser(t, stub, "testUser4", 100)
+	buy(t, stub, "testUser3", 500)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	withdrawFromUser(t, stub, "testUser2", 300)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("refund", `{"buyer": "testUser2", "value": 50}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to refund: %s", res.Message)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("clawback", `{"customer": "testUser4", "value": 40, "reason": "MISTAKE"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to clawback: %s", res.Message)
+		t.FailNow()
+	}
+
+	report := auditInvariants(t, stub)
+	if len(report.Discrepancies) != 0 || report.Customers != 2 || report.Issued != 1000 || report.Held != 710 || report.Claimed != 250 || report.Retired != 40 {
+		t.Errorf("unexpected audit report %+v", report)
+		t.FailNow()
+	}
+
+	// a balance which drifted from its assets
+	stub.MockTransactionStart("drift")
+	key, _ := stub.CreateCompositeKey(IndexCustomer, []string{"default/testUser4"})
+	stub.PutState(key, []byte{70, 0, 0, 0, 0, 0, 0, 0})
+	stub.MockTransactionEnd("drift")
+
+	report = auditInvariants(t, stub)
+	expected := AuditDiscrepancy{Check: AuditCustomerBalance, Actor: "default/testUser4", Expected: 70, Actual: 60}
+	if len(report.Discrepancies) != 1 || report.Discrepancies[0] != expected {
+		t.Errorf("unexpected discrepancies %+v", report.Discrepancies)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("auditInvariants"))
+	if res.Status == shim.OK {
+		t.Errorf("expected auditInvariants of a shop to fail")
+		t.FailNow()
+	}
+
+	// auditors are managed by the admins and need their MSP
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("u0", util.ToChaincodeArgs("addAuditor", `{"cn": "testUser3"}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected auditor without MSP to be rejected")
+		t.FailNow()
+	}
+	changeAdmins(t, stub, "u1", "addAuditor", `{"mspId": "default", "cn": "testUser3"}`)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	auditInvariants(t, stub)
+
+	stub.MockCreator("otherMSP", testdata.TestUser3Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("auditInvariants"))
+	if res.Status == shim.OK {
+		t.Errorf("expected auditor of another MSP to be rejected")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	changeAdmins(t, stub, "u2", "removeAuditor", `{"mspId": "default", "cn": "testUser3"}`)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("auditInvariants"))
+	if res.Status == shim.OK {
+		t.Errorf("expected removed auditor to be rejected")
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("getAdminAudit"))
+	var audit = []AdminAuditEntry{}
+	json.Unmarshal(res.Payload, &audit)
+	if len(audit) != 2 || audit[0].Action != "addAuditor" || audit[1].Action != "removeAuditor" || audit[1].Admin.CN != "testUser3" {
+		t.Errorf("unexpected admin audit %s", string(res.Payload))
+		t.FailNow()
+	}
+}
+
+func TestAmount(t *testing.T) {
+	if _, err := NewAmount(0); err != ErrZeroAmount {
+		t.Errorf("expected zero amount to be rejected, got %v", err)
+	}
+
+	max := Amount(math.MaxUint64)
+	if _, err := max.Add(1); err != ErrAmountOverflow {
+		t.Errorf("expected overflow, got %v", err)
+	}
+	if sum, err := (max - 1).Add(1); err != nil || sum != max {
+		t.Errorf("expected %d, got %d %v", max, sum, err)
+	}
+
+	if _, err := Amount(0).Sub(1); err != ErrAmountUnderflow {
+		t.Errorf("expected underflow, got %v", err)
+	}
+	if rest, err := max.Sub(max); err != nil || rest != 0 {
+		t.Errorf("expected 0, got %d %v", rest, err)
+	}
+
+	if _, err := changeAmount(5, 0, true); err != ErrZeroAmount {
+		t.Errorf("expected zero delta to be rejected, got %v", err)
+	}
+	if value, err := changeAmount(5, 5, true); err != nil || value != 0 {
+		t.Errorf("expected 0, got %d %v", value, err)
+	}
+}
+
+func TestAmountBoundaries(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "bank", "name": "testShop"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}, {"role": "customer", "name": "testCustomer"}]`)
+
+	max := uintToString(math.MaxUint64)
+	expectFailure := func(function string, body string) {
+		res := stub.MockInvoke("1", util.ToChaincodeArgs(function, body))
+		if res.Status == shim.OK {
+			t.Errorf("expected %s %s to fail", function, body)
+			t.FailNow()
+		}
+	}
+
+	expectFailure("provideAsset", `{"receiver": "testUser2", "value": 0}`)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": ` + max + `}`)
+	expectFailure("provideAsset", `{"receiver": "testUser2", "value": 1}`)
+	// the issued counter of the bank is full as well
+	expectFailure("provideAsset", `{"receiver": "testCustomer", "value": 1}`)
+	stub.MockCreator("default", testdata.TestShopCert)
+	provideAsset(t, stub, `{"receiver": "testCustomer", "value": 1}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if balance := getCustomerBalance(t, stub).Balance; balance != math.MaxUint64 {
+		t.Errorf("expected the maximum balance, got %d", balance)
+		t.FailNow()
+	}
+	expectFailure("transfer", `{"receiver": "testCustomer", "value": 0}`)
+	transferUserToUser(t, stub, "testCustomer", 1)
+
+	stub.MockCreator("default", testdata.TestCustomerCert)
+	expectFailure("transfer", `{"receiver": "testUser2", "value": 2}`)
+	transferUserToUser(t, stub, "testUser2", 1)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	expectFailure("redeem", `{"receiver": "testUser3", "value": 0}`)
+	buy(t, stub, "testUser3", math.MaxInt64)
+	expectFailure("redeem", `{"receiver": "testUser3", "value": ` + max + `}`)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("redeem", `{"receiver": "testUser3", "value": ` + uintToString(math.MaxUint64 - math.MaxInt64) + `}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to redeem: %s", res.Message)
+		t.FailNow()
+	}
+	expectFailure("redeem", `{"receiver": "testUser3", "value": 1}`)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	expectFailure("withdraw", `{"buyer": "testUser2", "value": 0}`)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("withdraw", `{"buyer": "testUser2", "value": ` + max + `}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to withdraw: %s", res.Message)
+		t.FailNow()
+	}
+	if balance := getShopBalance(t, stub).Balance; balance != math.MaxUint64 {
+		t.Errorf("expected the maximum shop balance, got %d", balance)
+		t.FailNow()
+	}
+	expectFailure("refund", `{"buyer": "testUser2", "value": 0}`)
+
+	stub.MockCreator("default", testdata.TestCustomerCert)
+	buy(t, stub, "testUser3", 1)
+	expectFailure("cancelRedemption", `{"shop": "testUser3", "value": 2}`)
+
+	// the shop and bank balances can't take another point
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	expectFailure("withdraw", `{"buyer": "testCustomer", "value": 1}`)
+}
+
+func TestPagination(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+	for i := 0; i < 5; i++ {
+		provideAsset(t, stub, `{"receiver": "testUser2", "value": 10}`)
+	}
+
+	// without page size the default page size applies
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if transfers := getCustomerBalanceInfo(t, stub); len(transfers) != 5 {
+		t.Errorf("expected 5 fragments, got %d", len(transfers))
+		t.FailNow()
+	}
+
+	seen := 0
+	query := PageQuery{PageSize: 2}
+	for pages := 1; ; pages++ {
+		args, _ := json.Marshal(query)
+		res := stub.MockInvoke("1", util.ToChaincodeArgs("customerBalanceInfo", string(args)))
+		if res.Status != shim.OK {
+			t.Errorf("Failed to getCustomerBalanceInfo: %s", res.Message)
+			t.FailNow()
+		}
+
+		transfers := []TransferEvent{}
+		page := Page{Records: &transfers}
+		json.Unmarshal(res.Payload, &page)
+		if page.Count != len(transfers) || page.Count > 2 {
+			t.Errorf("unexpected page %s", string(res.Payload))
+			t.FailNow()
+		}
+		seen += page.Count
+
+		if page.Bookmark == "" || pages > 5 {
+			break
+		}
+		query.Bookmark = page.Bookmark
+	}
+	if seen != 5 {
+		t.Errorf("expected 5 fragments over all pages, got %d", seen)
+		t.FailNow()
+	}
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("customerBalanceInfo", `{"pageSize": -1}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected a negative page size to fail")
+		t.FailNow()
+	}
+
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("customerBalanceInfo", `{"pageSize": 1001}`))
+	if res.Status == shim.OK {
+		t.Errorf("expected a page size above the maximum to fail")
+		t.FailNow()
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "bank", "name": "testShop"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}]`)
+
+	stub.MockTime(1000)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 10}`)
+	stub.MockTime(2000)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 30}`)
+	stub.MockTime(3000)
+	stub.MockCreator("default", testdata.TestShopCert)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 20}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	fragments := func(body string) []TransferEvent {
+		res := stub.MockInvoke("1", util.ToChaincodeArgs("customerBalanceInfo", body))
+		if res.Status != shim.OK {
+			t.Errorf("Failed to getCustomerBalanceInfo %s: %s", body, res.Message)
+			t.FailNow()
+		}
+		transfers := []TransferEvent{}
+		json.Unmarshal(res.Payload, &Page{Records: &transfers})
+		return transfers
+	}
+
+	if found := fragments(`{"from": 1500, "to": 2500}`); len(found) != 1 || found[0].Value != 30 {
+		t.Errorf("unexpected fragments in time range %+v", found)
+		t.FailNow()
+	}
+	if found := fragments(`{"counterparty": "testShop"}`); len(found) != 1 || found[0].Value != 20 {
+		t.Errorf("unexpected fragments of counterparty %+v", found)
+		t.FailNow()
+	}
+	if found := fragments(`{"bank": "testUser", "sort": "largest"}`); len(found) != 2 || found[0].Value != 30 || found[1].Value != 10 {
+		t.Errorf("unexpected fragments of bank %+v", found)
+		t.FailNow()
+	}
+	if found := fragments(`{"sort": "newest"}`); len(found) != 3 || found[0].Info.Timestamp != 3000 || found[2].Info.Timestamp != 1000 {
+		t.Errorf("unexpected fragment order %+v", found)
+		t.FailNow()
+	}
+	// the only match fills the page, the fragments after the bookmark don't match
+	if found := fragments(`{"bank": "testShop", "sort": "largest", "pageSize": 1}`); len(found) != 1 || found[0].Value != 20 {
+		t.Errorf("unexpected sorted full page %+v", found)
+		t.FailNow()
+	}
+
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("customerBalance", `{"from": 2000, "to": 3000}`))
+	user := User{}
+	json.Unmarshal(res.Payload, &user)
+	if res.Status != shim.OK || user.Balance != 60 || len(user.BalanceHistory) != 2 {
+		t.Errorf("unexpected balance history %+v", user)
+		t.FailNow()
+	}
+
+	// filtered pages are filled up with matching fragments, only the last one may be short
+	for _, filter := range []string{`"from": 1500`, `"bank": "testShop"`, `"bank": "testUser"`} {
+		seen := 0
+		bookmark := ""
+		for pages := 1; pages <= 4; pages++ {
+			quoted, _ := json.Marshal(bookmark)
+			res := stub.MockInvoke("1", util.ToChaincodeArgs("customerBalanceInfo", `{"pageSize": 1, "bookmark": ` + string(quoted) + `, ` + filter + `}`))
+			transfers := []TransferEvent{}
+			page := Page{Records: &transfers}
+			json.Unmarshal(res.Payload, &page)
+			if res.Status != shim.OK || (page.Bookmark != "" && page.Count != 1) {
+				t.Errorf("unexpected page of %s: %s %s", filter, res.Message, string(res.Payload))
+				t.FailNow()
+			}
+			seen += page.Count
+			bookmark = page.Bookmark
+			if bookmark == "" {
+				break
+			}
+		}
+		if expected := map[bool]int{true: 1, false: 2}[filter == `"bank": "testShop"`]; seen != expected || bookmark != "" {
+			t.Errorf("expected %d fragments of %s, got %d", expected, filter, seen)
+			t.FailNow()
+		}
+	}
+
+	for _, body := range []string{`{"sort": "random"}`, `{"from": 2000, "to": 1000}`, `{"sort": "newest", "pageSize": 2}`} {
+		res = stub.MockInvoke("1", util.ToChaincodeArgs("customerBalanceInfo", body))
+		if res.Status == shim.OK {
+			t.Errorf("expected customerBalanceInfo %s to fail", body)
+			t.FailNow()
+		}
+	}
+}
+
+func getLedger(t *testing.T, stub *mock.FullMockStub, body string) []LedgerEntry {
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("getLedger", body))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to getLedger: %s", res.Message)
+		t.FailNow()
+	}
+
+	entries := []LedgerEntry{}
+	json.Unmarshal(res.Payload, &Page{Records: &entries})
+	return entries
+}
+
+func TestLedger(t *testing.T) {
+	stub := initToken(t)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	createActors(t, stub, `[{"role": "bank", "name": "testUser"}, {"role": "customer", "name": "testUser2"}, {"role": "shop", "name": "testUser3"}, {"role": "customer", "name": "testCustomer"}]`)
+
+	stub.MockTime(1000)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 50, "memo": "welcome"}`)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	stub.MockTime(2000)
+	res := stub.MockInvoke("1", util.ToChaincodeArgs("transfer", `{"receiver": "testCustomer", "value": 10, "memo": "birthday"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to transfer: %s", res.Message)
+		t.FailNow()
+	}
+	stub.MockTime(3000)
+	buy(t, stub, "testUser3", 15)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	stub.MockTime(4000)
+	withdrawFromUser(t, stub, "testUser2", 5)
+	stub.MockTime(5000)
+	res = stub.MockInvoke("1", util.ToChaincodeArgs("refund", `{"buyer": "testUser2", "value": 2, "memo": "returned"}`))
+	if res.Status != shim.OK {
+		t.Errorf("Failed to refund: %s", res.Message)
+		t.FailNow()
+	}
+
+	expected := []LedgerEntry{
+		{Account: "shop", Movement: Movement{LedgerWithdraw, "default/testUser2", ""}, Amount: 5, Balance: 5, TxId: "1", Timestamp: 4000},
+		{Account: "shop", Movement: Movement{LedgerRefund, "default/testUser2", "returned"}, Amount: 2, Debit: true, Balance: 3, TxId: "1", Timestamp: 5000},
+	}
+	if entries := getLedger(t, stub, ""); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected shop ledger %+v", entries)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	expected = []LedgerEntry{
+		{Account: "customer", Movement: Movement{LedgerIssue, "default/testUser", "welcome"}, Amount: 50, Balance: 50, TxId: "1", Timestamp: 1000},
+		{Account: "customer", Movement: Movement{LedgerTransferOut, "default/testCustomer", "birthday"}, Amount: 10, Debit: true, Balance: 40, TxId: "1", Timestamp: 2000},
+		{Account: "customer", Movement: Movement{LedgerRedeem, "default/testUser3", ""}, Amount: 15, Debit: true, Balance: 25, TxId: "1", Timestamp: 3000},
+		{Account: "customer", Movement: Movement{LedgerRefund, "default/testUser3", "returned"}, Amount: 2, Balance: 27, TxId: "1", Timestamp: 5000},
+	}
+	if entries := getLedger(t, stub, ""); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected customer ledger %+v", entries)
+		t.FailNow()
+	}
+
+	if entries := getLedger(t, stub, `{"counterparty": "testUser3", "sort": "newest"}`); len(entries) != 2 || entries[0].Type != LedgerRefund {
+		t.Errorf("unexpected filtered ledger %+v", entries)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestCustomerCert)
+	if entries := getLedger(t, stub, ""); len(entries) != 1 || entries[0].Type != LedgerTransferIn || entries[0].Counterparty != "default/testUser2" || entries[0].Balance != 10 {
+		t.Errorf("unexpected receiver ledger %+v", entries)
+		t.FailNow()
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if entries := getLedger(t, stub, ""); len(entries) != 2 || entries[0].Type != LedgerWithdraw || entries[1].Type != LedgerRefund || entries[1].Balance != 3 {
+		t.Errorf("unexpected bank ledger %+v", entries)
+		t.FailNow()
+	}
+
+	// a withdraw over several fragments of the bank is a single movement of the bank
+	stub.MockTime(6000)
+	provideAsset(t, stub, `{"receiver": "testUser2", "value": 10}`)
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	buy(t, stub, "testUser3", 35)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	stub.MockTime(7000)
+	withdrawFromUser(t, stub, "testUser2", 45)
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if entries := getLedger(t, stub, `{"from": 7000}`); len(entries) != 1 || entries[0].Type != LedgerWithdraw || entries[0].Amount != 45 || entries[0].Balance != 48 {
+		t.Errorf("unexpected bank ledger of the withdraw %+v", entries)
+		t.FailNow()
+	}
+}
+
+func TestInitToken(t *testing.T) {
+	initToken(t)
+
+	// admins are bound to their MSP from the start
+	for _, body := range []string{`{"admin": "testUser"}`, `{"admins": [{"mspId": "default", "cn": "testUser"}], "admin": "testUser2"}`, `{"admins": [{"cn": "testUser"}]}`, `{}`} {
+		stub := mock.NewFullMockStub("loyalty", &LoyaltyChaincode{})
+		stub.MockCreator("default", testdata.TestUser1Cert)
+		res := stub.MockInit("1", util.ToChaincodeArgs("init", body))
+		if res.Status == shim.OK {
+			t.Errorf("expected init with %s to fail", body)
+			t.FailNow()
+		}
+	}
 }
 
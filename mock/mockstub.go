@@ -17,8 +17,10 @@ limitations under the License.
 package mock
 
 import (
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/msp"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
@@ -27,6 +29,7 @@ type FullMockStub struct {
 
 	cc          shim.Chaincode
 	mockCreator []byte
+	mockTime    *timestamp.Timestamp
 }
 
 func NewFullMockStub(name string, cc shim.Chaincode) *FullMockStub {
@@ -41,6 +44,18 @@ func (stub *FullMockStub) MockCreator(mspID string, cert string) {
 	stub.mockCreator, _ = msp.NewSerializedIdentity(mspID, []byte(cert))
 }
 
+// fixes the transaction timestamp of all following transactions
+func (stub *FullMockStub) MockTime(seconds int64) {
+	stub.mockTime = &timestamp.Timestamp{Seconds: seconds}
+}
+
+func (stub *FullMockStub) MockTransactionStart(uuid string) {
+	stub.MockStub.MockTransactionStart(uuid)
+	if stub.mockTime != nil {
+		stub.TxTimestamp = stub.mockTime
+	}
+}
+
 func (stub *FullMockStub) MockInit(uuid string, args [][]byte) pb.Response {
 	// this is a hack here to set MockStub.args, because its not accessible otherwise
 	stub.MockStub.MockInvoke(uuid, args)
@@ -67,3 +82,51 @@ func (stub *FullMockStub) MockInvoke(uuid string, args [][]byte) pb.Response {
 func (stub *FullMockStub) GetCreator() ([]byte, error) {
 	return stub.mockCreator, nil
 }
+
+// the fabric mock stub doesn't page, the bookmark is the key of the first entry of the next page
+func (stub *FullMockStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iterator.Close()
+
+	page := &pageIterator{}
+	next := ""
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if kv.Key < bookmark {
+			continue
+		}
+		if int32(len(page.kvs)) == pageSize {
+			next = kv.Key
+			break
+		}
+		page.kvs = append(page.kvs, kv)
+	}
+
+	return page, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(page.kvs)), Bookmark: next}, nil
+}
+
+// iterates the entries of a page
+type pageIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (it *pageIterator) HasNext() bool {
+	return len(it.kvs) > 0
+}
+
+func (it *pageIterator) Next() (*queryresult.KV, error) {
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+func (it *pageIterator) Close() error {
+	return nil
+}
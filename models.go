@@ -1,18 +1,47 @@
 package main
 
+type AdminIdentity struct {
+	MspId string `json:"mspId"`
+	CN    string `json:"cn"`
+}
+
 type Settings struct {
-	Admin        string `json:"admin"`
+	// CN-only admin of former versions, only read from the state until migrateIdentities binds it
+	Admin         string          `json:"admin,omitempty"`
+	Admins        []AdminIdentity `json:"admins"`
+	ValidityDays  uint64        `json:"validityDays"`
+	SpendStrategy SpendStrategy `json:"spendStrategy"`
+	AllowanceDays uint64        `json:"allowanceDays"`
+	CustomerApproval bool       `json:"customerApproval"`
+	Auditors      []AdminIdentity `json:"auditors,omitempty"`
 }
 
 type Asset struct {
 	History    	[]string `json:"history"`
 	Value   	uint64 `json:"value"`
+	IssuedAt	int64 `json:"issuedAt"`
+	Expiry		int64 `json:"expiry"`
+	ClaimedAt	int64 `json:"claimedAt,omitempty"`
+	Claim		string `json:"claim,omitempty"`
+	Frozen		bool `json:"frozen,omitempty"`
+	FrozenReason	string `json:"frozenReason,omitempty"`
+	Migrations	[]AssetMigration `json:"migrations,omitempty"`
 	Info  		InfoEntry `json:"info"`
 }
 
+// the change of the issuing bank of an asset, History[0] holds the current one
+type AssetMigration struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	TxId string `json:"txId"`
+}
+
 type User struct {
 	Role    	string `json:"role"`
 	Name        string `json:"name"`
+	MspId       string `json:"mspId,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Profile     *Profile `json:"profile,omitempty"`
 	Balance   	uint64 `json:"userBalance"`
 	BalanceHistory []HistoryEntry `json:"balanceHistory"`
 }
@@ -20,11 +49,31 @@ type User struct {
 type Transfer struct {
 	Receiver    string `json:"receiver"`
 	Value 		uint64 `json:"value"`
+	Deadline	int64 `json:"deadline,omitempty"`
+	SpendOptions
+}
+
+type SpendStrategy string
+
+const (
+	SpendKeyOrder      = SpendStrategy("")
+	SpendOldestFirst   = SpendStrategy("oldest")
+	SpendExpiringFirst = SpendStrategy("expiring")
+	SpendPreferBank    = SpendStrategy("bank")
+	SpendLargestFirst  = SpendStrategy("largest")
+)
+
+// selects the assets used first when spending, defaults to the strategy of the settings
+type SpendOptions struct {
+	Strategy   SpendStrategy `json:"strategy,omitempty"`
+	PreferBank string        `json:"preferBank,omitempty"`
 }
 
 type BankObligation struct {
 	Bank    string `json:"bank"`
+	Customer string `json:"customer"`
 	Value 	uint64 `json:"value"`
+	Info  	InfoEntry `json:"info"`
 }
 
 type TransferEvent struct {
@@ -35,7 +84,14 @@ type TransferEvent struct {
 }
 
 type Allowance struct {
+	Buyer    string `json:"buyer"`
+	Value    uint64 `json:"value"`
+	Deadline int64  `json:"deadline"`
+}
+
+type RedemptionCancel struct {
 	Buyer string `json:"buyer"`
+	Shop  string `json:"shop"`
 	Value uint64 `json:"value"`
 }
 
@@ -43,9 +99,356 @@ type AllowanceEvent struct {
 	Buyer string `json:"buyer"`
 	Value uint64 `json:"value"`
 	Shop  string `json:"shop"`
+	Deadline int64 `json:"deadline"`
 	Info  InfoEntry `json:"info"`
 }
 
+type ExpiryPolicy struct {
+	ValidityDays uint64 `json:"validityDays"`
+}
+
+type ExpiryEvent struct {
+	Customer string `json:"customer"`
+	Bank     string `json:"bank"`
+	Value    uint64 `json:"value"`
+}
+
+// the payload of the Expire event, fabric keeps one event per transaction so it names every customer who lost points
+type ExpirySweep struct {
+	Customers []string      `json:"customers"`
+	Expiries  []ExpiryEvent `json:"expiries"`
+}
+
+type SettlementStatus string
+
+const (
+	SettlementOpen    = SettlementStatus("open")
+	SettlementPaid    = SettlementStatus("paid")
+	SettlementSettled = SettlementStatus("settled")
+)
+
+type SettlementClaim struct {
+	Id    string `json:"id"`
+	Value uint64 `json:"value"`
+}
+
+type Settlement struct {
+	Id         string            `json:"id"`
+	Bank       string            `json:"bank"`
+	Shop       string            `json:"shop"`
+	Status     SettlementStatus  `json:"status"`
+	Value      uint64            `json:"value"`
+	PaymentRef string            `json:"paymentRef"`
+	Claims     []SettlementClaim `json:"claims"`
+}
+
+type SettlementRequest struct {
+	Id         string `json:"id"`
+	Shop       string `json:"shop"`
+	PaymentRef string `json:"paymentRef"`
+}
+
+type NettingObligation struct {
+	Payer string `json:"payer"`
+	Payee string `json:"payee"`
+	Value uint64 `json:"value"`
+}
+
+type NettingPosition struct {
+	Participant   string `json:"participant"`
+	Receivable    uint64 `json:"receivable"`
+	Payable       uint64 `json:"payable"`
+	NetReceivable uint64 `json:"netReceivable"`
+	NetPayable    uint64 `json:"netPayable"`
+}
+
+// the obligations a netting report covers
+type NettingScope string
+
+// only the open claims banks owe shops, a pair of participants nets where both act as bank and as shop
+const NettingBankClaims = NettingScope("bankClaims")
+
+type NettingReport struct {
+	Id        string              `json:"id"`
+	Scope     NettingScope        `json:"scope"`
+	CutOff    int64               `json:"cutOff"`
+	Claims    int                 `json:"claims"`
+	Gross     []NettingObligation `json:"gross"`
+	Net       []NettingObligation `json:"net"`
+	Positions []NettingPosition   `json:"positions"`
+}
+
+type NettingRequest struct {
+	Id     string `json:"id"`
+	CutOff int64  `json:"cutOff"`
+}
+
+type RetirementKind string
+
+const (
+	RetirementClawback = RetirementKind("clawback")
+	RetirementBurn     = RetirementKind("burn")
+	RetirementClosure  = RetirementKind("closure")
+)
+
+// points taken back by a bank, a clawback from a customer, a burn of claims from a shop or the points of a closed account
+type Retirement struct {
+	Id       string         `json:"id"`
+	Kind     RetirementKind `json:"kind"`
+	Bank     string         `json:"bank"`
+	Customer string         `json:"customer,omitempty"`
+	Shop     string         `json:"shop,omitempty"`
+	Value    uint64         `json:"value"`
+	Reason   string         `json:"reason"`
+}
+
+type AdminChange struct {
+	Admin AdminIdentity `json:"admin"`
+	New   AdminIdentity `json:"new"`
+}
+
+type AdminAuditEntry struct {
+	TxId      string          `json:"txId"`
+	Timestamp int64           `json:"timeStamp"`
+	Action    string          `json:"action"`
+	By        AdminIdentity   `json:"by"`
+	Admin     AdminIdentity   `json:"admin"`
+	New       *AdminIdentity  `json:"new,omitempty"`
+}
+
+type ActorStatus string
+
+const (
+	ActorActive    = ActorStatus("active")
+	ActorSuspended = ActorStatus("suspended")
+	ActorClosed    = ActorStatus("closed")
+)
+
+// the registry record of an identity, one per identity whatever roles it holds
+type Actor struct {
+	Id        string            `json:"id"`
+	Roles     []string          `json:"roles"`
+	Status    ActorStatus       `json:"status"`
+	StatusReason string         `json:"statusReason,omitempty"`
+	CreatedTx string            `json:"createdTx"`
+	CreatedAt int64             `json:"createdAt"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Profile   *Profile          `json:"profile,omitempty"`
+}
+
+// the public profile of an actor, category is the merchant category code (ISO 18245) of a shop
+type Profile struct {
+	DisplayName string `json:"displayName,omitempty"`
+	Category    string `json:"category,omitempty"`
+	LogoUrl     string `json:"logoUrl,omitempty"`
+	Contact     string `json:"contact,omitempty"`
+	Country     string `json:"country,omitempty"`
+}
+
+// metadata entries to set, an empty value removes the entry; set profile fields replace the stored ones
+type ActorUpdate struct {
+	Id       string            `json:"id"`
+	Metadata map[string]string `json:"metadata"`
+	Profile  *Profile          `json:"profile,omitempty"`
+}
+
+type ActorQuery struct {
+	PageQuery
+	Role     string `json:"role"`
+	Metadata bool   `json:"metadata"`
+}
+
+type DirectoryEntry struct {
+	Id       string            `json:"id"`
+	Role     string            `json:"role"`
+	Status   ActorStatus       `json:"status,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Profile  *Profile          `json:"profile,omitempty"`
+}
+
+type ActorPage struct {
+	Records  []DirectoryEntry `json:"records"`
+	Bookmark string           `json:"bookmark"`
+	Count    int              `json:"count"`
+}
+
+// the page arguments of the list queries, a page size of 0 gets the default page size
+type PageQuery struct {
+	PageSize int32  `json:"pageSize"`
+	Bookmark string `json:"bookmark"`
+}
+
+// a page of a list query, the bookmark is empty on the last page
+type Page struct {
+	Records  interface{} `json:"records"`
+	Bookmark string      `json:"bookmark"`
+	Count    int         `json:"count"`
+}
+
+// the order of list records, the key order by default
+type SortOrder string
+
+const (
+	SortKeyOrder = SortOrder("")
+	SortOldest   = SortOrder("oldest")
+	SortNewest   = SortOrder("newest")
+	SortSmallest = SortOrder("smallest")
+	SortLargest  = SortOrder("largest")
+)
+
+// the page and filters of a list query, a time of 0 leaves the range open
+type ListQuery struct {
+	PageQuery
+	From         int64     `json:"from"`
+	To           int64     `json:"to"`
+	Counterparty string    `json:"counterparty"`
+	Bank         string    `json:"bank"`
+	Sort         SortOrder `json:"sort"`
+}
+
+type OffboardingMode string
+
+const (
+	OffboardFreeze   = OffboardingMode("freeze")
+	OffboardTransfer = OffboardingMode("transfer")
+)
+
+type BankOffboarding struct {
+	Bank      string          `json:"bank"`
+	Mode      OffboardingMode `json:"mode"`
+	Successor string          `json:"successor,omitempty"`
+	Reason    string          `json:"reason"`
+	TxId      string          `json:"txId"`
+	Fragments int             `json:"fragments"`
+	Value     uint64          `json:"value"`
+}
+
+// issuance limits of a bank set by the admin, a cap of 0 means unlimited
+type IssuanceQuota struct {
+	Bank           string `json:"bank"`
+	OutstandingCap uint64 `json:"outstandingCap"`
+	PeriodCap      uint64 `json:"periodCap"`
+	PeriodDays     uint64 `json:"periodDays"`
+}
+
+// the points issued by a bank in the running period
+type IssuanceUsage struct {
+	PeriodStart  int64  `json:"periodStart"`
+	PeriodIssued uint64 `json:"periodIssued"`
+}
+
+type QuotaStatus struct {
+	IssuanceQuota
+	IssuanceUsage
+	Outstanding uint64  `json:"outstanding"`
+	Headroom    *uint64 `json:"headroom,omitempty"`
+}
+
+// the running counters of the points of a bank: issued in total, held freely by customers,
+// locked in allowances of customers and withdrawn by shops in total
+type BankLiability struct {
+	Bank              string `json:"bank,omitempty"`
+	Issued            uint64 `json:"issued"`
+	Outstanding       uint64 `json:"outstanding"`
+	PendingRedemption uint64 `json:"pendingRedemption"`
+	Claimed           uint64 `json:"claimed"`
+}
+
+// a value of the ledger which doesn't match the values it is derived from
+type AuditDiscrepancy struct {
+	Check    AuditCheck `json:"check"`
+	Actor    string     `json:"actor,omitempty"`
+	Expected uint64     `json:"expected"`
+	Actual   uint64     `json:"actual"`
+}
+
+type AuditCheck string
+
+const (
+	// customer balance plus open allowances against the customer assets
+	AuditCustomerBalance = AuditCheck("customerBalance")
+	// bank balance against the claims of the bank
+	AuditBankClaims = AuditCheck("bankClaims")
+	// held points of the bank liability against the customer assets issued by the bank
+	AuditBankHeld = AuditCheck("bankHeld")
+	// total issued against total held, claimed and retired (expired, clawed back, closed)
+	AuditSupply = AuditCheck("supply")
+)
+
+type AuditReport struct {
+	Customers     int                `json:"customers"`
+	Banks         int                `json:"banks"`
+	Issued        uint64             `json:"issued"`
+	Held          uint64             `json:"held"`
+	Claimed       uint64             `json:"claimed"`
+	Retired       uint64             `json:"retired"`
+	Discrepancies []AuditDiscrepancy `json:"discrepancies"`
+}
+
+type StatusChange struct {
+	Id     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// a single asset of a customer, e.g. a disputed amount
+type FragmentFreeze struct {
+	Customer string `json:"customer"`
+	Id       string `json:"id"`
+	Reason   string `json:"reason"`
+}
+
+// a self-registration waiting for approval, a customer names the approving bank,
+// banks and shops carry their id and role and wait for an admin
+type Registration struct {
+	Customer string   `json:"customer,omitempty"`
+	Bank     string   `json:"bank,omitempty"`
+	Id       string   `json:"id,omitempty"`
+	Role     string   `json:"role,omitempty"`
+	TxId     string   `json:"txId"`
+	Profile  *Profile `json:"profile,omitempty"`
+}
+
+// maps the CN-only names of the ledger to identities, by default of the MSP defaultMspId
+type IdentityMigration struct {
+	DefaultMspId string            `json:"defaultMspId"`
+	MspIds       map[string]string `json:"mspIds"`
+}
+
+type LedgerEntryType string
+
+const (
+	LedgerIssue       = LedgerEntryType("issue")
+	LedgerTransferIn  = LedgerEntryType("transferIn")
+	LedgerTransferOut = LedgerEntryType("transferOut")
+	LedgerRedeem      = LedgerEntryType("redeem")
+	LedgerRelease     = LedgerEntryType("release")
+	LedgerWithdraw    = LedgerEntryType("withdraw")
+	LedgerRefund      = LedgerEntryType("refund")
+	LedgerExpire      = LedgerEntryType("expire")
+	LedgerClawback    = LedgerEntryType("clawback")
+	LedgerBurn        = LedgerEntryType("burn")
+	LedgerClosure     = LedgerEntryType("closure")
+	LedgerSettle      = LedgerEntryType("settle")
+)
+
+// why the balance of an account changes, the memo is passed by the caller of the transaction
+type Movement struct {
+	Type         LedgerEntryType `json:"type"`
+	Counterparty string          `json:"counterparty,omitempty"`
+	Memo         string          `json:"memo,omitempty"`
+}
+
+// a change of the balance of an account, the account is the role of the owner whose balance changed
+type LedgerEntry struct {
+	Account string `json:"account"`
+	Movement
+	Amount    uint64 `json:"amount"`
+	Debit     bool   `json:"debit,omitempty"`
+	Balance   uint64 `json:"balance"`
+	TxId      string `json:"txId"`
+	Timestamp int64  `json:"timeStamp"`
+}
+
 type HistoryEntry struct {
 	Value 		string `json:"value"`
 	TxId 		string `json:"txId"`
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// gross obligations per payer and payee, built from the open bank claims up to the cut-off
+func (t *LoyaltyChaincode) grossObligations(stub shim.ChaincodeStubInterface, cutOff int64) (map[string]map[string]uint64, int, error) {
+	// claims in a settlement batch are already being paid bilaterally
+	batched, err := t.batchedClaims(stub)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexBankAsset, []string{})
+	if err != nil {
+		return nil, 0, errors.New("Could not build claim iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	gross := map[string]map[string]uint64{}
+	claims := 0
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		_, parts, _ := stub.SplitCompositeKey(kv.Key)
+		bank := parts[0]
+		shop := parts[1]
+		if batched[batchedClaimKey(bank, parts[2])] {
+			continue
+		}
+
+		asset := Asset{}
+		err = json.Unmarshal(kv.Value, &asset)
+		if err != nil {
+			return nil, 0, errors.New("asset parsing error: " + err.Error())
+		}
+
+		// claims older than the claim time are before any cut-off
+		if asset.ClaimedAt > cutOff {
+			continue
+		}
+
+		if gross[bank] == nil {
+			gross[bank] = map[string]uint64{}
+		}
+		gross[bank][shop] += asset.Value
+		claims++
+	}
+
+	return gross, claims, nil
+}
+
+func buildNettingReport(id string, cutOff int64, claims int, gross map[string]map[string]uint64) *NettingReport {
+	report := NettingReport{
+		Id: id,
+		Scope: NettingBankClaims,
+		CutOff: cutOff,
+		Claims: claims,
+		Gross: []NettingObligation{},
+		Net: []NettingObligation{},
+		Positions: []NettingPosition{},
+	}
+
+	positions := map[string]*NettingPosition{}
+	position := func(cn string) *NettingPosition {
+		if positions[cn] == nil {
+			positions[cn] = &NettingPosition{Participant: cn}
+		}
+		return positions[cn]
+	}
+
+	// map iteration is random, so the report is built from sorted participants
+	var payers []string
+	for payer := range gross {
+		payers = append(payers, payer)
+	}
+	sort.Strings(payers)
+
+	for _, payer := range payers {
+		var payees []string
+		for payee := range gross[payer] {
+			payees = append(payees, payee)
+		}
+		sort.Strings(payees)
+
+		for _, payee := range payees {
+			value := gross[payer][payee]
+			report.Gross = append(report.Gross, NettingObligation{Payer: payer, Payee: payee, Value: value})
+			position(payer).Payable += value
+			position(payee).Receivable += value
+
+			// bilateral net, every pair is handled once
+			reverse := gross[payee][payer]
+			if value > reverse {
+				report.Net = append(report.Net, NettingObligation{Payer: payer, Payee: payee, Value: value - reverse})
+			}
+		}
+	}
+
+	var participants []string
+	for cn := range positions {
+		participants = append(participants, cn)
+	}
+	sort.Strings(participants)
+
+	for _, cn := range participants {
+		p := positions[cn]
+		if p.Receivable > p.Payable {
+			p.NetReceivable = p.Receivable - p.Payable
+		} else {
+			p.NetPayable = p.Payable - p.Receivable
+		}
+		report.Positions = append(report.Positions, *p)
+	}
+
+	return &report
+}
+
+func (t *LoyaltyChaincode) computeNetting(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	// only admin is able to run the netting
+	if !settings.isAdmin(caller) {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request := NettingRequest{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &request)
+		if err != nil {
+			return shim.Error("Error parsing arguments")
+		}
+	}
+
+	cutOff := request.CutOff
+	if cutOff == 0 || cutOff > now {
+		cutOff = now
+	}
+
+	gross, claims, err := t.grossObligations(stub, cutOff)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	report := buildNettingReport(stub.GetTxID(), cutOff, claims, gross)
+
+	// reports are immutable
+	key, _ := stub.CreateCompositeKey(IndexNettingReport, []string{report.Id})
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if existing != nil {
+		return shim.Error("Netting report '" + report.Id + "' already exists")
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return shim.Error("Error saving netting report: " + err.Error())
+	}
+
+	stub.SetEvent("Netting", data)
+	return shim.Success(data)
+}
+
+// returns the netting report with the given id, or all reports without an id
+func (t *LoyaltyChaincode) getNettingReport(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if !settings.isAdmin(caller) && !t.userExists(stub, caller, "bank") && !t.userExists(stub, caller, "shop") {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	request := NettingRequest{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &request)
+		if err != nil {
+			return shim.Error("Error parsing arguments")
+		}
+	}
+
+	if request.Id != "" {
+		key, _ := stub.CreateCompositeKey(IndexNettingReport, []string{request.Id})
+		data, err := stub.GetState(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if data == nil {
+			return shim.Error("Netting report '" + request.Id + "' doesn't exist")
+		}
+		return shim.Success(data)
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexNettingReport, []string{})
+	if err != nil {
+		return shim.Error("Could not build netting iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	var result []*NettingReport = []*NettingReport{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		report := NettingReport{}
+		err = json.Unmarshal(kv.Value, &report)
+		if err != nil {
+			return shim.Error("netting report parsing error: " + err.Error())
+		}
+
+		result = append(result, &report)
+	}
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	return shim.Success(resultJson)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// the claims of shops against the bank which are not settled yet
+func (t *LoyaltyChaincode) unsettledClaims(stub shim.ChaincodeStubInterface, bank string) (int, uint64, error) {
+	claims, err := t.listAssets(stub, IndexBankAsset, bank)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	value := uint64(0)
+	for _, claim := range claims {
+		value += claim.Asset.Value
+	}
+	return len(claims), value, nil
+}
+
+// moves the amounts the bank provided to its customers to the successor
+func (t *LoyaltyChaincode) transferBanksCustomers(stub shim.ChaincodeStubInterface, bank string, successor string) error {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexBanksCustomers, []string{bank})
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	var customers []string
+	var values []uint64
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return err
+		}
+
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			iterator.Close()
+			return err
+		}
+
+		keys = append(keys, kv.Key)
+		customers = append(customers, parts[1])
+		values = append(values, binary.LittleEndian.Uint64(kv.Value))
+	}
+	iterator.Close()
+
+	for i, customer := range customers {
+		key, _ := stub.CreateCompositeKey(IndexBanksCustomers, []string{successor, customer})
+		data, err := stub.GetState(key)
+		if err != nil {
+			return err
+		}
+
+		provided := values[i]
+		if data != nil {
+			err = addAmount(&provided, binary.LittleEndian.Uint64(data))
+			if err != nil {
+				return errors.New("Error moving customer '" + customer + "': " + err.Error())
+			}
+		}
+
+		data = make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, provided)
+		err = stub.PutState(key, data)
+		if err != nil {
+			return err
+		}
+
+		err = stub.DelState(keys[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// takes a bank out of the consortium, the points it issued are either frozen or taken over by a successor bank.
+// Refused while shops hold unsettled claims against the bank.
+func (t *LoyaltyChaincode) offboardBank(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	// only admin is able to offboard a bank
+	if !settings.isAdmin(caller) {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("offboardBank expected 1 argument")
+	}
+
+	offboarding := BankOffboarding{}
+	err = json.Unmarshal([]byte(args[0]), &offboarding)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	// the counts are the outcome of the offboarding, never taken from the request
+	offboarding.Fragments = 0
+	offboarding.Value = 0
+
+	if offboarding.Bank == "" || offboarding.Reason == "" {
+		return shim.Error("Bad request: bank and reason are required")
+	}
+
+	err = t.resolveActors(stub, &offboarding.Bank, &offboarding.Successor)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	if !t.userExists(stub, offboarding.Bank, "bank") {
+		return shim.Error("Bad request: bank doesn't exist")
+	}
+
+	switch offboarding.Mode {
+	case OffboardFreeze:
+		offboarding.Successor = ""
+	case OffboardTransfer:
+		if offboarding.Successor == offboarding.Bank || !t.userExists(stub, offboarding.Successor, "bank") {
+			return shim.Error("Bad request: successor must be another existing bank")
+		}
+		err = t.checkActive(stub, offboarding.Successor)
+		if err != nil {
+			return shim.Error("Bad request: " + err.Error())
+		}
+	default:
+		return shim.Error("Unknown offboarding mode '" + string(offboarding.Mode) + "', expected freeze or transfer")
+	}
+
+	actor, err := t.getActor(stub, offboarding.Bank)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if actor.Status == ActorClosed {
+		return shim.Error("Bank '" + offboarding.Bank + "' is already offboarded")
+	}
+
+	n, value, err := t.unsettledClaims(stub, offboarding.Bank)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if n > 0 {
+		return shim.Error("Bank '" + offboarding.Bank + "' has " + uintToString(uint64(n)) + " unsettled claims of " + uintToString(value) + " points")
+	}
+
+	// the fragments of all customers issued by the bank
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomerAsset, []string{})
+	if err != nil {
+		return shim.Error("Could not build asset iterator: " + err.Error())
+	}
+
+	var fragments []assetEntry
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return shim.Error(err.Error())
+		}
+
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			iterator.Close()
+			return shim.Error("Error splitting composite key" + err.Error())
+		}
+
+		asset := Asset{}
+		err = json.Unmarshal(kv.Value, &asset)
+		if err != nil {
+			iterator.Close()
+			return shim.Error("asset parsing error: " + err.Error())
+		}
+
+		if asset.History[0] == offboarding.Bank {
+			fragments = append(fragments, assetEntry{Owner: parts[0], Spender: parts[1], Id: parts[2], Asset: asset})
+		}
+	}
+	iterator.Close()
+
+	for _, entry := range fragments {
+		asset := entry.Asset
+		if offboarding.Mode == OffboardFreeze {
+			asset.Frozen = true
+			asset.FrozenReason = "BANK_OFFBOARDED: " + offboarding.Reason
+		} else {
+			asset.History[0] = offboarding.Successor
+			asset.Migrations = append(asset.Migrations, AssetMigration{
+				From: offboarding.Bank,
+				To:   offboarding.Successor,
+				TxId: stub.GetTxID(),
+			})
+		}
+
+		_, err = t.storeAsset(stub, IndexCustomerAsset, entry.Owner, entry.Spender, entry.Id, asset)
+		if err != nil {
+			return shim.Error("Error updating Asset '" + entry.Owner + "-" + entry.Spender + "-" + entry.Id + "':" + err.Error())
+		}
+
+		offboarding.Fragments++
+		offboarding.Value += asset.Value
+	}
+
+	if offboarding.Mode == OffboardTransfer {
+		err = t.transferBanksCustomers(stub, offboarding.Bank, offboarding.Successor)
+		if err != nil {
+			return shim.Error("Error moving bank customers: " + err.Error())
+		}
+
+		err = t.transferPendingRedemptions(stub, offboarding.Bank, offboarding.Successor)
+		if err != nil {
+			return shim.Error("Error moving pending redemptions: " + err.Error())
+		}
+
+		// the successor takes over the points still held by customers, issued and claimed stay with the bank
+		liability, err := t.getLiability(stub, offboarding.Bank)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		deltas := liabilityDeltas{}
+		deltas.of(offboarding.Bank).outstanding.down(liability.Outstanding)
+		deltas.of(offboarding.Bank).pending.down(liability.PendingRedemption)
+		deltas.of(offboarding.Successor).outstanding.up(liability.Outstanding)
+		deltas.of(offboarding.Successor).pending.up(liability.PendingRedemption)
+		err = t.changeLiabilities(stub, deltas)
+		if err != nil {
+			return shim.Error("Error moving liability: " + err.Error())
+		}
+	}
+
+	actor.Status = ActorClosed
+	actor.StatusReason = offboarding.Reason
+	_, err = t.putActor(stub, actor)
+	if err != nil {
+		return shim.Error("Error saving actor: " + err.Error())
+	}
+
+	offboarding.TxId = stub.GetTxID()
+	data, _ := json.Marshal(offboarding)
+	key, _ := stub.CreateCompositeKey(IndexBankOffboarding, []string{offboarding.Bank})
+	err = stub.PutState(key, data)
+	if err != nil {
+		return shim.Error("Error saving offboarding: " + err.Error())
+	}
+
+	stub.SetEvent("BankOffboarding", data)
+	return shim.Success(data)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// the page size of list queries without pageSize and the largest page a query may ask for
+const (
+	DefaultPageSize int32 = 100
+	MaxPageSize     int32 = 1000
+)
+
+// a missing page size gets the default one, larger pages than the maximum are refused
+func (q *PageQuery) applyLimits() error {
+	switch {
+	case q.PageSize < 0:
+		return errors.New("Bad request: pageSize can't be negative")
+	case q.PageSize > MaxPageSize:
+		return errors.New("Bad request: pageSize can't exceed " + strconv.Itoa(int(MaxPageSize)))
+	case q.PageSize == 0:
+		q.PageSize = DefaultPageSize
+	}
+	return nil
+}
+
+// calls visit for the entries of the partial key from the bookmark on until pageSize entries matched, visit tells
+// whether an entry matched. Only the last page holds fewer entries, the bookmark is empty after it
+func (t *LoyaltyChaincode) visitPage(stub shim.ChaincodeStubInterface, objectType string, keys []string, query PageQuery, visit func(key string, value []byte) (bool, error)) (string, error) {
+	bookmark := query.Bookmark
+	for matched := int32(0); matched < query.PageSize; {
+		// never reads past the entry which completes the page, so the bookmark is where the next page starts
+		iterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, keys, query.PageSize - matched, bookmark)
+		if err != nil {
+			return "", errors.New("Could not build iterator: " + err.Error())
+		}
+
+		for iterator.HasNext() {
+			kv, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return "", err
+			}
+
+			ok, err := visit(kv.Key, kv.Value)
+			if err != nil {
+				iterator.Close()
+				return "", err
+			}
+			if ok {
+				matched++
+			}
+		}
+		iterator.Close()
+
+		if metadata.Bookmark == "" || metadata.FetchedRecordsCount == 0 {
+			return "", nil
+		}
+		bookmark = metadata.Bookmark
+	}
+
+	return bookmark, nil
+}
+
+func pageResponse(records interface{}, count int, bookmark string) pb.Response {
+	resultJson, err := json.Marshal(Page{Records: records, Bookmark: bookmark, Count: count})
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	return shim.Success(resultJson)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"regexp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var categoryPattern = regexp.MustCompile(`^[0-9]{4}$`)
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// checks the profile fields, the merchant category is only meaningful for shops
+func validateProfile(profile *Profile, roles []string) error {
+	if profile.Category != "" {
+		if !categoryPattern.MatchString(profile.Category) {
+			return errors.New("Bad request: category must be a 4 digit merchant category code")
+		}
+
+		shop := false
+		for _, role := range roles {
+			shop = shop || role == "shop"
+		}
+		if !shop {
+			return errors.New("Bad request: only shops have a category")
+		}
+	}
+
+	if profile.Country != "" && !countryPattern.MatchString(profile.Country) {
+		return errors.New("Bad request: country must be an ISO 3166 alpha-2 code")
+	}
+
+	if profile.LogoUrl != "" {
+		u, err := url.Parse(profile.LogoUrl)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("Bad request: logoUrl must be a http(s) URL")
+		}
+	}
+
+	return nil
+}
+
+// the profile of the actor, nil if none was set
+func (t *LoyaltyChaincode) getProfile(stub shim.ChaincodeStubInterface, id string) (*Profile, error) {
+	key, _ := stub.CreateCompositeKey(IndexProfile, []string{id})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Error fetching profile:" + err.Error())
+	} else if data == nil {
+		return nil, nil
+	}
+
+	profile := Profile{}
+	err = json.Unmarshal(data, &profile)
+	if err != nil {
+		return nil, errors.New("Error parsing profile:" + err.Error())
+	}
+
+	return &profile, nil
+}
+
+// merges the set fields of update into the stored profile of the actor
+func (t *LoyaltyChaincode) updateProfile(stub shim.ChaincodeStubInterface, actor *Actor, update *Profile) (*Profile, error) {
+	profile, err := t.getProfile(stub, actor.Id)
+	if err != nil {
+		return nil, err
+	} else if profile == nil {
+		profile = &Profile{}
+	}
+
+	if update.DisplayName != "" {
+		profile.DisplayName = update.DisplayName
+	}
+	if update.Category != "" {
+		profile.Category = update.Category
+	}
+	if update.LogoUrl != "" {
+		profile.LogoUrl = update.LogoUrl
+	}
+	if update.Contact != "" {
+		profile.Contact = update.Contact
+	}
+	if update.Country != "" {
+		profile.Country = update.Country
+	}
+
+	err = validateProfile(profile, actor.Roles)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexProfile, []string{actor.Id})
+	err = stub.PutState(key, data)
+	if err != nil {
+		return nil, errors.New("Error saving profile: " + err.Error())
+	}
+
+	return profile, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// the limits of the bank, no quota means unlimited issuance
+func (t *LoyaltyChaincode) getQuota(stub shim.ChaincodeStubInterface, bank string) (*IssuanceQuota, error) {
+	key, _ := stub.CreateCompositeKey(IndexBankQuota, []string{bank})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Error fetching quota:" + err.Error())
+	}
+
+	quota := IssuanceQuota{Bank: bank}
+	if data != nil {
+		err = json.Unmarshal(data, &quota)
+		if err != nil {
+			return nil, errors.New("Error parsing quota:" + err.Error())
+		}
+	}
+
+	return &quota, nil
+}
+
+func (t *LoyaltyChaincode) getIssuanceUsage(stub shim.ChaincodeStubInterface, bank string) (*IssuanceUsage, error) {
+	key, _ := stub.CreateCompositeKey(IndexBankIssuance, []string{bank})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Error fetching issuance:" + err.Error())
+	}
+
+	usage := IssuanceUsage{}
+	if data != nil {
+		err = json.Unmarshal(data, &usage)
+		if err != nil {
+			return nil, errors.New("Error parsing issuance:" + err.Error())
+		}
+	}
+
+	return &usage, nil
+}
+
+func (t *LoyaltyChaincode) putIssuanceUsage(stub shim.ChaincodeStubInterface, bank string, usage *IssuanceUsage) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexBankIssuance, []string{bank})
+	return stub.PutState(key, data)
+}
+
+// a new period starts once the running one is over
+func (u *IssuanceUsage) rollPeriod(quota *IssuanceQuota, now int64) {
+	if quota.PeriodDays == 0 || now >= u.PeriodStart + int64(quota.PeriodDays) * secondsPerDay {
+		u.PeriodStart = now
+		u.PeriodIssued = 0
+	}
+}
+
+// the amount the bank may still issue, nil if unlimited
+func quotaHeadroom(quota *IssuanceQuota, usage *IssuanceUsage, outstanding uint64) *uint64 {
+	var headroom *uint64
+	limit := func(cap uint64, used uint64) {
+		left := uint64(0)
+		if used < cap {
+			left = cap - used
+		}
+		if headroom == nil || left < *headroom {
+			headroom = &left
+		}
+	}
+
+	if quota.OutstandingCap > 0 {
+		limit(quota.OutstandingCap, outstanding)
+	}
+	if quota.PeriodCap > 0 {
+		limit(quota.PeriodCap, usage.PeriodIssued)
+	}
+	return headroom
+}
+
+// checks the quota of the bank for the issuance of value and books it
+func (t *LoyaltyChaincode) useIssuanceQuota(stub shim.ChaincodeStubInterface, bank string, value uint64) error {
+	quota, err := t.getQuota(stub, bank)
+	if err != nil {
+		return err
+	}
+
+	usage, err := t.getIssuanceUsage(stub, bank)
+	if err != nil {
+		return err
+	}
+
+	liability, err := t.getLiability(stub, bank)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	usage.rollPeriod(quota, now)
+
+	headroom := quotaHeadroom(quota, usage, liability.held())
+	if headroom != nil && value > *headroom {
+		return errors.New("Issuance quota of '" + bank + "' exceeded, " + uintToString(*headroom) + " points left")
+	}
+
+	issued, err := Amount(usage.PeriodIssued).Add(Amount(value))
+	if err != nil {
+		return errors.New("Issuance of '" + bank + "' in the running period: " + err.Error())
+	}
+	usage.PeriodIssued = uint64(issued)
+	return t.putIssuanceUsage(stub, bank, usage)
+}
+
+func (t *LoyaltyChaincode) setIssuanceQuota(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	// only admin is able to set quotas
+	if !settings.isAdmin(caller) {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("setIssuanceQuota expected 1 argument")
+	}
+
+	quota := IssuanceQuota{}
+	err = json.Unmarshal([]byte(args[0]), &quota)
+	if err != nil {
+		return shim.Error("Error parsing quota json")
+	}
+
+	err = t.resolveActors(stub, &quota.Bank)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	if !t.userExists(stub, quota.Bank, "bank") {
+		return shim.Error("Bad request: bank doesn't exist")
+	}
+
+	if quota.PeriodCap > 0 && quota.PeriodDays == 0 {
+		return shim.Error("Bad request: a period cap needs periodDays")
+	}
+
+	data, _ := json.Marshal(quota)
+	key, _ := stub.CreateCompositeKey(IndexBankQuota, []string{quota.Bank})
+	err = stub.PutState(key, data)
+	if err != nil {
+		return shim.Error("Error saving quota: " + err.Error())
+	}
+
+	return shim.Success(data)
+}
+
+// the quota, usage and headroom of the calling bank, the admin may ask for any bank
+func (t *LoyaltyChaincode) getIssuanceQuota(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	request := IssuanceQuota{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &request)
+		if err != nil {
+			return shim.Error("Error parsing arguments")
+		}
+	}
+
+	if request.Bank == "" {
+		request.Bank = caller
+	}
+	err = t.resolveActors(stub, &request.Bank)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	if request.Bank != caller && !settings.isAdmin(caller) {
+		return shim.Error("Only the admin can read the quota of another bank")
+	}
+
+	if !t.userExists(stub, request.Bank, "bank") {
+		return shim.Error("Bad request: bank doesn't exist")
+	}
+
+	quota, err := t.getQuota(stub, request.Bank)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	usage, err := t.getIssuanceUsage(stub, request.Bank)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	liability, err := t.getLiability(stub, request.Bank)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	usage.rollPeriod(quota, now)
+
+	status := QuotaStatus{
+		IssuanceQuota: *quota,
+		IssuanceUsage: *usage,
+		Outstanding:   liability.held(),
+		Headroom:      quotaHeadroom(quota, usage, liability.held()),
+	}
+
+	data, _ := json.Marshal(status)
+	return shim.Success(data)
+}
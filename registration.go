@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// registers the caller with the role of its certificate attribute, see RoleAttribute.
+// Banks and shops wait for the approval of an admin, customers for the approval of the given bank
+// if the settings ask for it.
+func (t *LoyaltyChaincode) register(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	role, ok, err := CallerAttribute(stub, RoleAttribute)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if !ok {
+		return shim.Error("Your certificate has no '" + RoleAttribute + "' attribute")
+	}
+
+	if !validRole(role) {
+		return shim.Error("Unknown role '" + role + "'")
+	}
+
+	if t.userExists(stub, caller, role) {
+		return shim.Error("'" + caller + "' is already registered as " + role)
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	registration := Registration{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &registration)
+		if err != nil {
+			return shim.Error("Error parsing arguments")
+		}
+	}
+
+	if registration.Profile != nil {
+		err = validateProfile(registration.Profile, []string{role})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if role != "customer" {
+		key, _ := stub.CreateCompositeKey(IndexRoleRegistrations, []string{role, caller})
+		return t.putRegistration(stub, key, Registration{Id: caller, Role: role, Profile: registration.Profile})
+	}
+
+	if settings.CustomerApproval {
+		if registration.Bank == "" {
+			return shim.Error("register expected the approving bank")
+		}
+
+		err = t.resolveActors(stub, &registration.Bank)
+		if err != nil {
+			return shim.Error("Bad request: " + err.Error())
+		}
+
+		if !t.userExists(stub, registration.Bank, "bank") {
+			return shim.Error("Bad request: bank doesn't exist")
+		}
+
+		key, _ := stub.CreateCompositeKey(IndexBankRegistrations, []string{registration.Bank, caller})
+		return t.putRegistration(stub, key, Registration{Customer: caller, Bank: registration.Bank, Profile: registration.Profile})
+	}
+
+	actor, err := t.createActor(stub, caller, []string{role}, nil, registration.Profile)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	mspId, _ := SplitIdentity(caller)
+	data, _ := json.Marshal(User{Role: role, Name: caller, MspId: mspId, Profile: actor.Profile})
+	return shim.Success(data)
+}
+
+// stores a pending registration, a registrant waits for one decision at a time
+func (t *LoyaltyChaincode) putRegistration(stub shim.ChaincodeStubInterface, key string, registration Registration) pb.Response {
+	pending, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Error fetching registration: " + err.Error())
+	} else if pending != nil {
+		return shim.Error("Registration is already pending")
+	}
+
+	registration.TxId = stub.GetTxID()
+	data, _ := json.Marshal(registration)
+	err = stub.PutState(key, data)
+	if err != nil {
+		return shim.Error("Error saving registration: " + err.Error())
+	}
+
+	stub.SetEvent("Registration", data)
+	return shim.Success(data)
+}
+
+// lets the bank approve or reject a pending customer registration, and an admin a bank or shop registration
+func (t *LoyaltyChaincode) decideRegistration(stub shim.ChaincodeStubInterface, args []string, approve bool) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("Registration decision expected 1 argument")
+	}
+
+	request := Registration{}
+	err = json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	var key, id, role string
+	if request.Role != "" {
+		settings, err := t.getSettings(stub)
+		if err != nil {
+			return shim.Error("Error getting settings")
+		}
+
+		if !settings.isAdmin(caller) {
+			return shim.Error("Only admins decide on bank and shop registrations")
+		}
+		key, _ = stub.CreateCompositeKey(IndexRoleRegistrations, []string{request.Role, request.Id})
+		id, role = request.Id, request.Role
+	} else {
+		if !t.userExists(stub, caller, "bank") {
+			return shim.Error("I don't know you, " + caller + "!")
+		}
+		key, _ = stub.CreateCompositeKey(IndexBankRegistrations, []string{caller, request.Customer})
+		id, role = request.Customer, "customer"
+	}
+
+	data, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Error fetching registration: " + err.Error())
+	} else if data == nil {
+		return shim.Error("No pending registration of '" + id + "'")
+	}
+
+	err = stub.DelState(key)
+	if err != nil {
+		return shim.Error("Error removing registration: " + err.Error())
+	}
+
+	if approve && !t.userExists(stub, id, role) {
+		registration := Registration{}
+		err = json.Unmarshal(data, &registration)
+		if err != nil {
+			return shim.Error("registration parsing error: " + err.Error())
+		}
+
+		_, err = t.createActor(stub, id, []string{role}, nil, registration.Profile)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if approve {
+		stub.SetEvent("RegistrationApproved", data)
+	} else {
+		stub.SetEvent("RegistrationRejected", data)
+	}
+
+	return shim.Success(data)
+}
+
+func (t *LoyaltyChaincode) listRegistrations(stub shim.ChaincodeStubInterface, prefix string, keys []string) ([]*Registration, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(prefix, keys)
+	if err != nil {
+		return nil, errors.New("Could not build registration iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	var result []*Registration = []*Registration{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		registration := Registration{}
+		err = json.Unmarshal(kv.Value, &registration)
+		if err != nil {
+			return nil, errors.New("registration parsing error: " + err.Error())
+		}
+
+		result = append(result, &registration)
+	}
+
+	return result, nil
+}
+
+// the pending registrations of the calling bank, admins get the bank and shop registrations as well
+func (t *LoyaltyChaincode) getRegistrations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	admin := settings.isAdmin(caller)
+	bank := t.userExists(stub, caller, "bank")
+	if !admin && !bank {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	var result []*Registration = []*Registration{}
+	if admin {
+		registrations, err := t.listRegistrations(stub, IndexRoleRegistrations, []string{})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result = append(result, registrations...)
+	}
+	if bank {
+		registrations, err := t.listRegistrations(stub, IndexBankRegistrations, []string{caller})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result = append(result, registrations...)
+	}
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	return shim.Success(resultJson)
+}
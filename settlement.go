@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+func (t *LoyaltyChaincode) getSettlement(stub shim.ChaincodeStubInterface, id string) (*Settlement, error) {
+	key, _ := stub.CreateCompositeKey(IndexSettlement, []string{id})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Error fetching settlement:" + err.Error())
+	} else if data == nil {
+		return nil, errors.New("Settlement '" + id + "' doesn't exist")
+	}
+
+	settlement := Settlement{}
+	err = json.Unmarshal(data, &settlement)
+	if err != nil {
+		return nil, errors.New("Error parsing settlement:" + err.Error())
+	}
+
+	return &settlement, nil
+}
+
+func (t *LoyaltyChaincode) putSettlement(stub shim.ChaincodeStubInterface, settlement *Settlement) ([]byte, error) {
+	data, err := json.Marshal(settlement)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexSettlement, []string{settlement.Id})
+	return data, stub.PutState(key, data)
+}
+
+func (t *LoyaltyChaincode) allSettlements(stub shim.ChaincodeStubInterface) ([]*Settlement, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexSettlement, []string{})
+	if err != nil {
+		return nil, errors.New("Could not build settlement iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	var result []*Settlement = []*Settlement{}
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		settlement := Settlement{}
+		err = json.Unmarshal(kv.Value, &settlement)
+		if err != nil {
+			return nil, errors.New("settlement parsing error: " + err.Error())
+		}
+
+		result = append(result, &settlement)
+	}
+
+	return result, nil
+}
+
+// all settlements the bank or shop takes part in
+func (t *LoyaltyChaincode) participantSettlements(stub shim.ChaincodeStubInterface, cn string) ([]*Settlement, error) {
+	settlements, err := t.allSettlements(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Settlement = []*Settlement{}
+	for _, settlement := range settlements {
+		if settlement.Bank == cn || settlement.Shop == cn {
+			result = append(result, settlement)
+		}
+	}
+
+	return result, nil
+}
+
+func batchedClaimKey(bank string, id string) string {
+	return bank + "~" + id
+}
+
+// the claims which are part of an unsettled batch, see batchedClaimKey
+func (t *LoyaltyChaincode) batchedClaims(stub shim.ChaincodeStubInterface) (map[string]bool, error) {
+	settlements, err := t.allSettlements(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	batched := map[string]bool{}
+	for _, settlement := range settlements {
+		if settlement.Status == SettlementSettled {
+			continue
+		}
+		for _, claim := range settlement.Claims {
+			batched[batchedClaimKey(settlement.Bank, claim.Id)] = true
+		}
+	}
+
+	return batched, nil
+}
+
+// the ids of the claims named by shop assets of the shop
+func (t *LoyaltyChaincode) namedClaims(stub shim.ChaincodeStubInterface, shop string) (map[string]bool, error) {
+	assets, err := t.listAssets(stub, IndexShopAsset, shop)
+	if err != nil {
+		return nil, err
+	}
+
+	named := map[string]bool{}
+	for _, entry := range assets {
+		if entry.Asset.Claim != "" {
+			named[entry.Asset.Claim] = true
+		}
+	}
+	return named, nil
+}
+
+// consumes the shop side of the bank's claims, each claim takes the shop asset which names it. Shop assets
+// withdrawn before claims were named are reduced by value per customer, once per customer
+func (t *LoyaltyChaincode) consumeShopSide(stub shim.ChaincodeStubInterface, shop string, bank string, claims []assetEntry) error {
+	named, err := t.namedClaims(stub, shop)
+	if err != nil {
+		return err
+	}
+
+	var unnamed []assetEntry
+	for _, claim := range claims {
+		if !named[claim.Id] {
+			unnamed = append(unnamed, claim)
+			continue
+		}
+
+		id := claim.Id
+		_, err = t.consumeAssets(stub, IndexShopAsset, shop, claim.Asset.Value, func(entry assetEntry) bool {
+			return entry.Asset.Claim == id
+		})
+		if err != nil {
+			return errors.New("Error removing shop side of claim '" + id + "': " + err.Error())
+		}
+	}
+
+	customers, values := valuesPerCustomer(unnamed)
+	for _, customer := range customers {
+		_, err = t.consumeAssets(stub, IndexShopAsset, shop, values[customer], func(entry assetEntry) bool {
+			return entry.Asset.Claim == "" && entry.Spender == customer && entry.Asset.History[0] == bank
+		})
+		if err != nil {
+			return errors.New("Error removing shop assets: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// a bank opens a settlement batch over all claims of a shop which are not part of another batch
+func (t *LoyaltyChaincode) openSettlement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	bank, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if !t.userExists(stub, bank, "bank") {
+		return shim.Error("I don't know you, " + bank + "!")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("openSettlement expected 1 argument")
+	}
+
+	request := SettlementRequest{}
+	err = json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	err = t.resolveActors(stub, &request.Shop)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	if !t.userExists(stub, request.Shop, "shop") {
+		return shim.Error("Bad request: shop doesn't exist")
+	}
+
+	batched, err := t.batchedClaims(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexBankAsset, []string{bank, request.Shop})
+	if err != nil {
+		return shim.Error("Could not build claim iterator: " + err.Error())
+	}
+	defer iterator.Close()
+
+	settlement := Settlement{
+		Id: stub.GetTxID(),
+		Bank: bank,
+		Shop: request.Shop,
+		Status: SettlementOpen,
+		Claims: []SettlementClaim{},
+	}
+
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, parts, _ := stub.SplitCompositeKey(kv.Key)
+		if batched[batchedClaimKey(bank, parts[2])] {
+			continue
+		}
+
+		asset := Asset{}
+		err = json.Unmarshal(kv.Value, &asset)
+		if err != nil {
+			return shim.Error("asset parsing error: " + err.Error())
+		}
+
+		settlement.Claims = append(settlement.Claims, SettlementClaim{Id: parts[2], Value: asset.Value})
+		settlement.Value += asset.Value
+	}
+
+	if len(settlement.Claims) == 0 {
+		return shim.Error("No open claims of shop '" + request.Shop + "' to settle")
+	}
+
+	data, err := t.putSettlement(stub, &settlement)
+	if err != nil {
+		return shim.Error("Error saving settlement: " + err.Error())
+	}
+
+	stub.SetEvent("Settlement", data)
+	return shim.Success(data)
+}
+
+// the bank records the reference of the off-chain payment
+func (t *LoyaltyChaincode) recordSettlementPayment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	bank, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("recordSettlementPayment expected 1 argument")
+	}
+
+	request := SettlementRequest{}
+	err = json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	if request.PaymentRef == "" {
+		return shim.Error("Bad request: payment reference is missing")
+	}
+
+	settlement, err := t.getSettlement(stub, request.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if settlement.Bank != bank {
+		return shim.Error("Settlement '" + request.Id + "' doesn't belong to you, " + bank + "!")
+	}
+
+	if settlement.Status != SettlementOpen {
+		return shim.Error("Settlement '" + request.Id + "' is " + string(settlement.Status))
+	}
+
+	settlement.PaymentRef = request.PaymentRef
+	settlement.Status = SettlementPaid
+
+	data, err := t.putSettlement(stub, settlement)
+	if err != nil {
+		return shim.Error("Error saving settlement: " + err.Error())
+	}
+
+	stub.SetEvent("Settlement", data)
+	return shim.Success(data)
+}
+
+// the shop confirms the payment, the settled claims are removed from the bank and the shop
+func (t *LoyaltyChaincode) confirmSettlement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	shop, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("confirmSettlement expected 1 argument")
+	}
+
+	request := SettlementRequest{}
+	err = json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	settlement, err := t.getSettlement(stub, request.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if settlement.Shop != shop {
+		return shim.Error("Settlement '" + request.Id + "' doesn't belong to you, " + shop + "!")
+	}
+
+	if settlement.Status != SettlementPaid {
+		return shim.Error("Settlement '" + request.Id + "' is " + string(settlement.Status) + ", payment must be recorded first")
+	}
+
+	var claims []assetEntry
+	for _, claim := range settlement.Claims {
+		key, _ := stub.CreateCompositeKey(IndexBankAsset, []string{settlement.Bank, shop, claim.Id})
+		data, err := stub.GetState(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if data == nil {
+			return shim.Error("Claim '" + claim.Id + "' of settlement '" + request.Id + "' doesn't exist anymore")
+		}
+
+		asset := Asset{}
+		err = json.Unmarshal(data, &asset)
+		if err != nil {
+			return shim.Error("asset parsing error: " + err.Error())
+		}
+
+		err = t.removeAsset(stub, IndexBankAsset, settlement.Bank, shop, claim.Id)
+		if err != nil {
+			return shim.Error("Error removing claim '" + claim.Id + "': " + err.Error())
+		}
+
+		claims = append(claims, assetEntry{Id: claim.Id, Asset: asset})
+	}
+
+	err = t.consumeShopSide(stub, shop, settlement.Bank, claims)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.updateUserBalance(stub, IndexBank, settlement.Bank, settlement.Value, true, Movement{LedgerSettle, shop, settlement.PaymentRef})
+	if err != nil {
+		return shim.Error("Error updating bank balance: " + err.Error())
+	}
+
+	err = t.updateUserBalance(stub, IndexShop, shop, settlement.Value, true, Movement{LedgerSettle, settlement.Bank, settlement.PaymentRef})
+	if err != nil {
+		return shim.Error("Error updating shop balance: " + err.Error())
+	}
+
+	settlement.Status = SettlementSettled
+
+	data, err := t.putSettlement(stub, settlement)
+	if err != nil {
+		return shim.Error("Error saving settlement: " + err.Error())
+	}
+
+	stub.SetEvent("Settlement", data)
+	return shim.Success(data)
+}
+
+func (t *LoyaltyChaincode) getSettlements(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if !t.userExists(stub, caller, "bank") && !t.userExists(stub, caller, "shop") {
+		return shim.Error("I don't know you, " + caller + "!")
+	}
+
+	settlements, err := t.participantSettlements(stub, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultJson, err := json.Marshal(settlements)
+	if err != nil {
+		return shim.Error("Could not marshal json: " + err.Error())
+	}
+
+	return shim.Success(resultJson)
+}
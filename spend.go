@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// fills in the strategy of the settings if the call doesn't choose one
+func (t *LoyaltyChaincode) spendOptions(stub shim.ChaincodeStubInterface, requested SpendOptions) (SpendOptions, error) {
+	options := requested
+	if options.Strategy == SpendKeyOrder {
+		settings, err := t.getSettings(stub)
+		if err != nil {
+			return options, err
+		}
+		options.Strategy = settings.SpendStrategy
+	}
+
+	switch options.Strategy {
+	case SpendKeyOrder, SpendOldestFirst, SpendExpiringFirst, SpendLargestFirst:
+	case SpendPreferBank:
+		if options.PreferBank == "" {
+			return options, errors.New("Spend strategy 'bank' needs a preferBank")
+		}
+		bank, err := t.resolveActor(stub, options.PreferBank)
+		if err != nil {
+			return options, err
+		}
+		options.PreferBank = bank
+	default:
+		return options, errors.New("Unknown spend strategy '" + string(options.Strategy) + "'")
+	}
+
+	return options, nil
+}
+
+// orders the assets in the sequence they are spent, ties keep the key order
+func sortAssets(assets []assetEntry, options SpendOptions) {
+	var less func(a, b *Asset) bool
+
+	switch options.Strategy {
+	case SpendOldestFirst:
+		less = func(a, b *Asset) bool {
+			return a.IssuedAt < b.IssuedAt
+		}
+	case SpendExpiringFirst:
+		// assets without expiry come last
+		less = func(a, b *Asset) bool {
+			if a.Expiry == 0 || b.Expiry == 0 {
+				return b.Expiry == 0 && a.Expiry != 0
+			}
+			return a.Expiry < b.Expiry
+		}
+	case SpendPreferBank:
+		less = func(a, b *Asset) bool {
+			return a.History[0] == options.PreferBank && b.History[0] != options.PreferBank
+		}
+	case SpendLargestFirst:
+		less = func(a, b *Asset) bool {
+			return a.Value > b.Value
+		}
+	default:
+		return
+	}
+
+	sort.SliceStable(assets, func(i, j int) bool {
+		return less(&assets[i].Asset, &assets[j].Asset)
+	})
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// the functions of the Invoke switch which change the ledger
+var mutatingFunctions = map[string]bool{
+	"transfer":                 true,
+	"createActors":             true,
+	"provideAsset":             true,
+	"redeem":                   true,
+	"withdraw":                 true,
+	"cancelRedemption":         true,
+	"releaseExpiredAllowances": true,
+	"refund":                   true,
+	"clawback":                 true,
+	"burn":                     true,
+	"addAdmin":                 true,
+	"removeAdmin":              true,
+	"rotateAdmin":              true,
+	"addAuditor":               true,
+	"removeAuditor":            true,
+	"migrateAssetIds":          true,
+	"migrateIdentities":        true,
+	"updateActor":              true,
+	"freezeAccount":            true,
+	"unfreezeAccount":          true,
+	"closeAccount":             true,
+	"offboardBank":             true,
+	"setIssuanceQuota":         true,
+	"freezeFragment":           true,
+	"unfreezeFragment":         true,
+	"register":                 true,
+	"approveRegistration":      true,
+	"rejectRegistration":       true,
+	"setExpiryPolicy":          true,
+	"expirePoints":             true,
+	"openSettlement":           true,
+	"recordSettlementPayment":  true,
+	"confirmSettlement":        true,
+	"computeNetting":           true,
+}
+
+// fails if the actor is suspended or closed or can't be read, unknown identities (e.g. admins) are active
+func (t *LoyaltyChaincode) checkActive(stub shim.ChaincodeStubInterface, id string) error {
+	actor, err := t.findActor(stub, id)
+	if err != nil {
+		return err
+	} else if actor == nil {
+		return nil
+	}
+
+	if actor.Status != ActorActive {
+		msg := "Account of '" + id + "' is " + string(actor.Status)
+		if actor.StatusReason != "" {
+			msg += ": " + actor.StatusReason
+		}
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+func (t *LoyaltyChaincode) checkCallerActive(stub shim.ChaincodeStubInterface) error {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return errors.New("Error extracting user identity")
+	}
+	return t.checkActive(stub, caller)
+}
+
+// the admin may change every account, a bank the accounts of its customers
+func (t *LoyaltyChaincode) mayChangeAccount(stub shim.ChaincodeStubInterface, caller string, id string) (bool, error) {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return false, errors.New("Error getting settings")
+	}
+
+	if settings.isAdmin(caller) {
+		return true, nil
+	}
+
+	if !t.userExists(stub, caller, "bank") {
+		return false, nil
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexBanksCustomers, []string{caller, id})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	return data != nil, nil
+}
+
+// suspends or reactivates an account, a closed account stays closed
+func (t *LoyaltyChaincode) changeAccountStatus(stub shim.ChaincodeStubInterface, args []string, status ActorStatus) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("Account status change expected 1 argument")
+	}
+
+	change := StatusChange{}
+	err = json.Unmarshal([]byte(args[0]), &change)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	if change.Id == "" || change.Reason == "" {
+		return shim.Error("Bad request: id and reason are required")
+	}
+
+	err = t.resolveActors(stub, &change.Id)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	allowed, err := t.mayChangeAccount(stub, caller, change.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if !allowed {
+		return shim.Error("Only the admin or a bank of the customer can change the account of '" + change.Id + "'")
+	}
+
+	actor, err := t.getActor(stub, change.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if actor.Status == ActorClosed {
+		return shim.Error("Account of '" + change.Id + "' is closed")
+	} else if actor.Status == status {
+		return shim.Error("Account of '" + change.Id + "' is already " + string(status))
+	}
+
+	actor.Status = status
+	actor.StatusReason = change.Reason
+	if status == ActorActive {
+		actor.StatusReason = ""
+	}
+
+	data, err := t.putActor(stub, actor)
+	if err != nil {
+		return shim.Error("Error saving actor: " + err.Error())
+	}
+
+	stub.SetEvent("AccountStatus", data)
+	return shim.Success(data)
+}
+
+// freezes or unfreezes a single asset of a customer, allowed for the admin and the issuing bank
+func (t *LoyaltyChaincode) freezeFragment(stub shim.ChaincodeStubInterface, args []string, freeze bool) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	if len(args) != 1 {
+		return shim.Error("Fragment freeze expected 1 argument")
+	}
+
+	request := FragmentFreeze{}
+	err = json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	if request.Customer == "" || request.Id == "" || (freeze && request.Reason == "") {
+		return shim.Error("Bad request: customer, id and reason are required")
+	}
+
+	err = t.resolveActors(stub, &request.Customer)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	assets, err := t.listAssets(stub, IndexCustomerAsset, request.Customer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var fragment *assetEntry
+	for i := range assets {
+		if assets[i].Id == request.Id {
+			fragment = &assets[i]
+		}
+	}
+	if fragment == nil {
+		return shim.Error("Fragment '" + request.Id + "' of '" + request.Customer + "' doesn't exist")
+	}
+
+	if !settings.isAdmin(caller) && fragment.Asset.History[0] != caller {
+		return shim.Error("Only the admin or the issuing bank can freeze a fragment")
+	}
+
+	if fragment.Asset.Frozen == freeze {
+		return shim.Error("Fragment '" + request.Id + "' is already in the requested state")
+	}
+
+	asset := fragment.Asset
+	asset.Frozen = freeze
+	asset.FrozenReason = request.Reason
+	if !freeze {
+		asset.FrozenReason = ""
+	}
+
+	stored, err := t.storeAsset(stub, IndexCustomerAsset, fragment.Owner, fragment.Spender, fragment.Id, asset)
+	if err != nil {
+		return shim.Error("Error updating Asset '" + request.Id + "':" + err.Error())
+	}
+
+	data, _ := json.Marshal(stored)
+	return shim.Success(data)
+}
+
+// closes the account of a customer: open allowances are cancelled and all points go back to the issuing banks.
+// Called by the customer itself or the admin.
+func (t *LoyaltyChaincode) closeAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	request := StatusChange{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &request)
+		if err != nil {
+			return shim.Error("Error parsing arguments")
+		}
+	}
+
+	if request.Id == "" {
+		request.Id = caller
+	}
+	err = t.resolveActors(stub, &request.Id)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	if request.Id != caller && !settings.isAdmin(caller) {
+		return shim.Error("Only the admin or the customer itself can close an account")
+	}
+
+	if !t.userExists(stub, request.Id, "customer") {
+		return shim.Error("Bad request: customer doesn't exist")
+	}
+
+	actor, err := t.getActor(stub, request.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if actor.Status == ActorClosed {
+		return shim.Error("Account of '" + request.Id + "' is already closed")
+	} else if len(actor.Roles) > 1 {
+		return shim.Error("'" + request.Id + "' has other roles than customer, its account can't be closed")
+	}
+
+	// cancel the open allowances, the reserved points are returned with all others
+	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomerAllowances, []string{request.Id})
+	if err != nil {
+		return shim.Error("Could not build allowance iterator: " + err.Error())
+	}
+
+	open := map[string]uint64{}
+	var shops []string
+	for iterator.HasNext() {
+		kv, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return shim.Error(err.Error())
+		}
+
+		_, parts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			iterator.Close()
+			return shim.Error("Error splitting composite key" + err.Error())
+		}
+
+		allowance := Allowance{}
+		err = json.Unmarshal(kv.Value, &allowance)
+		if err != nil {
+			iterator.Close()
+			return shim.Error("allowance parsing error: " + err.Error())
+		}
+
+		if allowance.Value > 0 {
+			shops = append(shops, parts[1])
+			open[parts[1]] = allowance.Value
+		}
+	}
+	iterator.Close()
+
+	locked := uint64(0)
+	for _, shop := range shops {
+		locked += open[shop]
+
+		_, err = t.updateAllowance(stub, IndexCustomerAllowances, request.Id, shop, open[shop], true, 0)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, err = t.updateAllowance(stub, IndexShopAllowances, shop, request.Id, open[shop], true, 0)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// return every fragment to its issuing bank
+	assets, err := t.listAssets(stub, IndexCustomerAsset, request.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	unlocked, err := t.unlockPending(stub, request.Id, locked, nil)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var banks []string
+	perBank := map[string]uint64{}
+	deltas := liabilityDeltas{}
+	for bank, value := range unlocked {
+		deltas.of(bank).pending.down(value)
+		deltas.of(bank).outstanding.up(value)
+	}
+	for _, entry := range assets {
+		err = t.removeAsset(stub, IndexCustomerAsset, entry.Owner, entry.Spender, entry.Id)
+		if err != nil {
+			return shim.Error("Error removing Asset '" + entry.Owner + "-" + entry.Spender + "-" + entry.Id + "':" + err.Error())
+		}
+
+		bank := entry.Asset.History[0]
+		if _, ok := perBank[bank]; !ok {
+			banks = append(banks, bank)
+		}
+		perBank[bank] += entry.Asset.Value
+	}
+
+	var retirements []*Retirement = []*Retirement{}
+	for _, bank := range banks {
+		err = t.reduceBanksCustomer(stub, bank, request.Id, perBank[bank])
+		if err != nil {
+			return shim.Error("Error updating bank customer: " + err.Error())
+		}
+
+		deltas.of(bank).outstanding.down(perBank[bank])
+
+		retirement := Retirement{
+			Id:       stub.GetTxID(),
+			Kind:     RetirementClosure,
+			Bank:     bank,
+			Customer: request.Id,
+			Value:    perBank[bank],
+			Reason:   request.Reason,
+		}
+		_, err = t.putRetirement(stub, &retirement)
+		if err != nil {
+			return shim.Error("Error saving closure: " + err.Error())
+		}
+		retirements = append(retirements, &retirement)
+	}
+
+	err = t.changeLiabilities(stub, deltas)
+	if err != nil {
+		return shim.Error("Error updating liability: " + err.Error())
+	}
+
+	// the ledger shows the released allowances coming back before the balance is retired
+	balance, err := t.userBalance(stub, IndexCustomer, request.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, shop := range shops {
+		err = addAmount(&balance, open[shop])
+		if err != nil {
+			return shim.Error("Error releasing allowance of '" + shop + "': " + err.Error())
+		}
+		err = t.appendLedger(stub, IndexCustomer, request.Id, Movement{LedgerRelease, shop, request.Reason}, open[shop], false, balance)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if balance > 0 {
+		err = t.appendLedger(stub, IndexCustomer, request.Id, Movement{LedgerClosure, "", request.Reason}, balance, true, 0)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = t.setInitUserBalance(stub, IndexCustomer, request.Id, 0)
+	if err != nil {
+		return shim.Error("Error updating customer balance: " + err.Error())
+	}
+
+	actor.Status = ActorClosed
+	actor.StatusReason = request.Reason
+	_, err = t.putActor(stub, actor)
+	if err != nil {
+		return shim.Error("Error saving actor: " + err.Error())
+	}
+
+	data, _ := json.Marshal(retirements)
+	stub.SetEvent("AccountClosed", data)
+	return shim.Success(data)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/binary"
 	"errors"
-	"encoding/json"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
@@ -19,7 +18,8 @@ func (t *LoyaltyChaincode) setInitUserBalance(stub shim.ChaincodeStubInterface,
 	return stub.PutState(key, data)
 }
 
-func (t *LoyaltyChaincode) updateUserBalance(stub shim.ChaincodeStubInterface, prefix string, cn string, delta uint64, negSign bool) error {
+// changes the balance and books the movement in the ledger of the account
+func (t *LoyaltyChaincode) updateUserBalance(stub shim.ChaincodeStubInterface, prefix string, cn string, delta uint64, negSign bool, movement Movement) error {
 
 	key, _ := stub.CreateCompositeKey(prefix, []string{cn})
 	data, err := stub.GetState(key)
@@ -29,20 +29,19 @@ func (t *LoyaltyChaincode) updateUserBalance(stub shim.ChaincodeStubInterface, p
 		return errors.New("User '" + cn + "' doesn't exist")
 	}
 
-	newBalance := binary.LittleEndian.Uint64(data)
-
-	if negSign {
-		if newBalance - delta < 0 {
-			return errors.New("balance of user '" + cn + "' is to small to proceed transaction")
-		}
-		newBalance -= delta
-	} else {
-		newBalance += delta
+	newBalance, err := changeAmount(binary.LittleEndian.Uint64(data), delta, negSign)
+	if err != nil {
+		return errors.New("balance of user '" + cn + "': " + err.Error())
 	}
 
 	data = make([]byte, 8)
 	binary.LittleEndian.PutUint64(data, newBalance)
-	return stub.PutState(key, data)
+	err = stub.PutState(key, data)
+	if err != nil {
+		return err
+	}
+
+	return t.appendLedger(stub, prefix, cn, movement, delta, negSign, newBalance)
 }
 
 func (t *LoyaltyChaincode) userBalance(stub shim.ChaincodeStubInterface, prefix string, cn string) (uint64, error) {
@@ -60,15 +59,31 @@ func (t *LoyaltyChaincode) userBalance(stub shim.ChaincodeStubInterface, prefix
 	return binary.LittleEndian.Uint64(data), nil
 }
 
-func (t *LoyaltyChaincode) makeGiftToTheUserAsBank(stub shim.ChaincodeStubInterface, bankCn string, userCn string, balance uint64) error {
+func (t *LoyaltyChaincode) makeGiftToTheUserAsBank(stub shim.ChaincodeStubInterface, bankCn string, userCn string, balance uint64, memo string) error {
 
-	if balance < 0 {
-		return errors.New("gift to the user can't be negative")
+	_, err := NewAmount(balance)
+	if err != nil {
+		return errors.New("gift to the user: " + err.Error())
 	}
 
-	_, err := t.createAsset(stub, IndexCustomerAsset, userCn, bankCn, []string{bankCn}, balance)
+	expiry, err := t.pointsExpiry(stub, bankCn)
 	if err != nil {
-		return errors.New("Could not create Asset for '" + userCn + "':" + err.Error())
+		return errors.New("Could not determine points expiry: " + err.Error())
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+
+	// the sums are checked before anything is written
+	userBalance, err := t.userBalance(stub, IndexCustomer, userCn)
+	if err != nil {
+		return err
+	}
+	_, err = changeAmount(userBalance, balance, false)
+	if err != nil {
+		return errors.New("balance of user '" + userCn + "': " + err.Error())
 	}
 
 	key, _ := stub.CreateCompositeKey(IndexBanksCustomers, []string{bankCn, userCn})
@@ -79,7 +94,21 @@ func (t *LoyaltyChaincode) makeGiftToTheUserAsBank(stub shim.ChaincodeStubInterf
 	}
 
 	if data != nil {
-		newBallance += binary.LittleEndian.Uint64(data)
+		newBallance, err = changeAmount(binary.LittleEndian.Uint64(data), balance, false)
+		if err != nil {
+			return errors.New("amount provided to '" + userCn + "': " + err.Error())
+		}
+	}
+
+	gift := Asset{
+		History: []string{bankCn},
+		Value: balance,
+		IssuedAt: now,
+		Expiry: expiry,
+	}
+	_, err = t.createAsset(stub, IndexCustomerAsset, userCn, bankCn, gift)
+	if err != nil {
+		return errors.New("Could not create Asset for '" + userCn + "':" + err.Error())
 	}
 
 	data = make([]byte, 8)
@@ -90,52 +119,59 @@ func (t *LoyaltyChaincode) makeGiftToTheUserAsBank(stub shim.ChaincodeStubInterf
 		return err
 	}
 
+	deltas := liabilityDeltas{}
+	deltas.of(bankCn).issued.up(balance)
+	deltas.of(bankCn).outstanding.up(balance)
+	err = t.changeLiabilities(stub, deltas)
+	if err != nil {
+		return errors.New("Error updating liability: " + err.Error())
+	}
 
-	return t.updateUserBalance(stub, IndexCustomer, userCn, balance, false)
+	return t.updateUserBalance(stub, IndexCustomer, userCn, balance, false, Movement{LedgerIssue, bankCn, memo})
 }
 
 
-func (t *LoyaltyChaincode) getBanksCustomers(stub shim.ChaincodeStubInterface, bankCn string) ([]*User, error) {
-
-	iterator, err := stub.GetStateByPartialCompositeKey(IndexBanksCustomers, []string{bankCn})
-	if err != nil {
-		return nil, err
-	}
-	defer iterator.Close()
+func (t *LoyaltyChaincode) getBanksCustomers(stub shim.ChaincodeStubInterface, bankCn string, query ListQuery) ([]*User, string, error) {
 
 	var result []*User = []*User{}
-	for i := 0; iterator.HasNext(); i++ {
-		kv, err := iterator.Next()
-
+	bookmark, err := t.visitPage(stub, IndexBanksCustomers, query.keys(bankCn), query.PageQuery, func(key string, value []byte) (bool, error) {
+		history, err := t.getHistory(stub, key, UInt64)
 		if err != nil {
-			return nil, err
+			history = nil
 		}
+		history = query.filterHistory(history)
 
-		history, err := t.getHistory(stub, kv.Key, UInt64)
+		_, parts, err := stub.SplitCompositeKey(key)
 		if err != nil {
-			history = nil
+			return false, err
 		}
-
-		_, parts, err := stub.SplitCompositeKey(kv.Key)
 		cName := parts[1]
-		cBalance := kv.Value
+		cBalance := value
+
+		profile, err := t.getProfile(stub, cName)
+		if err != nil {
+			return false, err
+		}
 
 		customer := User{
 			Name: cName,
+			Profile: profile,
 			Balance:  binary.LittleEndian.Uint64(cBalance),
 			BalanceHistory: history,
 		}
 
 		result = append(result, &customer)
-	}
+		return true, nil
+	})
 
-	return result, nil
+	return result, bookmark, err
 }
 
-func (t *LoyaltyChaincode) userToUserTransfer(stub shim.ChaincodeStubInterface, fromCn string, toCn string, trValue uint64) error {
+func (t *LoyaltyChaincode) userToUserTransfer(stub shim.ChaincodeStubInterface, fromCn string, toCn string, trValue uint64, options SpendOptions, memo string) error {
 
-	if trValue < 0 {
-		return errors.New("transfer can't be negative")
+	_, err := NewAmount(trValue)
+	if err != nil {
+		return errors.New("transfer: " + err.Error())
 	}
 
 	// get the balances from state
@@ -148,38 +184,48 @@ func (t *LoyaltyChaincode) userToUserTransfer(stub shim.ChaincodeStubInterface,
 		return errors.New(fromCn + " does not have enough userBalance")
 	}
 
-	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomerAsset, []string{fromCn})
+	toBalance, err := t.userBalance(stub, IndexCustomer, toCn)
+	if err != nil {
+		return errors.New("Error getting to or from userBalance:" + err.Error())
+	}
+	_, err = changeAmount(toBalance, trValue, false)
 	if err != nil {
-		return errors.New("Could not build invoice iterator: " + err.Error())
+		return errors.New("balance of user '" + toCn + "': " + err.Error())
 	}
-	defer iterator.Close()
 
-	restSum := trValue
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; iterator.HasNext(); i++ {
-		kv, err := iterator.Next()
+	spendable, err := t.spendableBalance(stub, fromCn, now)
+	if err != nil {
+		return err
+	} else if spendable < trValue {
+		return errors.New(fromCn + " does not have enough unexpired points")
+	}
 
-		if err != nil {
-			return errors.New(err.Error())
-		}
+	assets, err := t.listAssets(stub, IndexCustomerAsset, fromCn)
+	if err != nil {
+		return err
+	}
+	sortAssets(assets, options)
 
-		_, parts, err := stub.SplitCompositeKey(kv.Key)
-		if err != nil {
-			return errors.New("Error splitting composite key" + err.Error())
-		}
+	restSum := trValue
 
-		sourceCn := parts[1]
-		id := parts[2]
+	for _, entry := range assets {
+		sourceCn := entry.Spender
+		id := entry.Id
+		asset := entry.Asset
 
-		asset:= Asset{}
-		err = json.Unmarshal(kv.Value, &asset)
-		if err != nil {
-			return err
+		// expired and frozen points can't be spent
+		if asset.expired(now) || asset.Frozen {
+			continue
 		}
 
 		if asset.Value <= restSum {
 			asset.History = append(asset.History, fromCn)
-			_, err = t.createAsset(stub, IndexCustomerAsset, toCn, fromCn, asset.History, asset.Value)
+			_, err = t.createAsset(stub, IndexCustomerAsset, toCn, fromCn, asset)
 			if err != nil {
 				return errors.New("Error creating Asset for '" + toCn + "':" + err.Error())
 			}
@@ -189,12 +235,15 @@ func (t *LoyaltyChaincode) userToUserTransfer(stub shim.ChaincodeStubInterface,
 			}
 			restSum -= asset.Value
 		} else {
-			_, err = t.storeAsset(stub, IndexCustomerAsset, fromCn, sourceCn, id, asset.History, asset.Value - restSum)
+			rest := asset
+			rest.Value = asset.Value - restSum
+			_, err = t.storeAsset(stub, IndexCustomerAsset, fromCn, sourceCn, id, rest)
 			if err != nil {
 				return errors.New("Error updating Asset '" + fromCn + "-" + sourceCn + "-" + id+ "':" + err.Error())
 			}
 			asset.History = append(asset.History, fromCn)
-			_, err = t.createAsset(stub, IndexCustomerAsset, toCn, fromCn, asset.History, restSum)
+			asset.Value = restSum
+			_, err = t.createAsset(stub, IndexCustomerAsset, toCn, fromCn, asset)
 			if err != nil {
 				return errors.New("Error creating Asset for '" + toCn + "':" + err.Error())
 			}
@@ -210,8 +259,10 @@ func (t *LoyaltyChaincode) userToUserTransfer(stub shim.ChaincodeStubInterface,
 		return errors.New("User Balance and the sum of his assets have different amount of tokens")
 	}
 
-	err = t.updateUserBalance(stub, IndexCustomer, fromCn, trValue, true)
-	err = t.updateUserBalance(stub, IndexCustomer, toCn, trValue, false)
+	err = t.updateUserBalance(stub, IndexCustomer, fromCn, trValue, true, Movement{LedgerTransferOut, toCn, memo})
+	if err == nil {
+		err = t.updateUserBalance(stub, IndexCustomer, toCn, trValue, false, Movement{LedgerTransferIn, fromCn, memo})
+	}
 	if err != nil {
 		return errors.New("Error setting to or from userBalance: " + err.Error())
 	}
@@ -220,7 +271,7 @@ func (t *LoyaltyChaincode) userToUserTransfer(stub shim.ChaincodeStubInterface,
 	return nil
 }
 
-func (t *LoyaltyChaincode) withdrawUserAssets(stub shim.ChaincodeStubInterface, userCn string, shopCn string, claim uint64) error {
+func (t *LoyaltyChaincode) withdrawUserAssets(stub shim.ChaincodeStubInterface, userCn string, shopCn string, claim uint64, options SpendOptions, memo string) error {
 
 	allowance, err := t.getAllowance(stub, IndexShopAllowances, shopCn, userCn)
 	if err != nil {
@@ -231,55 +282,59 @@ func (t *LoyaltyChaincode) withdrawUserAssets(stub shim.ChaincodeStubInterface,
 		return errors.New("Shop claim is bigger then allowed by user!" )
 	}
 
-	iterator, err := stub.GetStateByPartialCompositeKey(IndexCustomerAsset, []string{userCn})
+	now, err := txTime(stub)
 	if err != nil {
-		return errors.New("Could not build invoice iterator: " + err.Error())
+		return err
 	}
-	defer iterator.Close()
 
-	restSum := claim
+	if allowance.expired(now) {
+		return errors.New("Allowance of '" + userCn + "' expired, the points were released")
+	}
 
-	for i := 0; iterator.HasNext(); i++ {
-		kv, err := iterator.Next()
+	assets, err := t.listAssets(stub, IndexCustomerAsset, userCn)
+	if err != nil {
+		return err
+	}
+	sortAssets(assets, options)
 
-		if err != nil {
-			return errors.New(err.Error())
+	unfrozen := uint64(0)
+	for _, entry := range assets {
+		if !entry.Asset.Frozen {
+			unfrozen += entry.Asset.Value
 		}
+	}
+	if unfrozen < claim {
+		return errors.New("Points of '" + userCn + "' are frozen")
+	}
 
-		_, parts, err := stub.SplitCompositeKey(kv.Key)
-		if err != nil {
-			return errors.New("Error splitting composite key" + err.Error())
-		}
+	restSum := claim
+	var banks []string
+	perBank := map[string]uint64{}
 
-		sourceCn := parts[1]
-		id := parts[2]
+	for _, entry := range assets {
+		sourceCn := entry.Spender
+		id := entry.Id
 
-		asset:= Asset{}
-		err = json.Unmarshal(kv.Value, &asset)
-		if err != nil {
-			return err
+		// points earmarked by redeem stay withdrawable even if they expired meanwhile
+		asset := entry.Asset
+		if asset.Frozen {
+			continue
 		}
 
+		if _, ok := perBank[asset.History[0]]; !ok {
+			banks = append(banks, asset.History[0])
+		}
 		if asset.Value <= restSum {
-			asset.History = append(asset.History, userCn)
-
-			// move asset to shop
-			_, err = t.createAsset(stub, IndexShopAsset, shopCn, userCn, asset.History, asset.Value)
-			if err != nil {
-				return errors.New("Error creating Asset for '" + shopCn + "':" + err.Error())
-			}
-
-			// move asset to bank since it shops claim
-			asset.History = append(asset.History, shopCn)
-			_, err = t.createAsset(stub, IndexBankAsset, asset.History[0], shopCn, asset.History, asset.Value)
-			if err != nil {
-				return errors.New("Error creating Asset for '" + asset.History[0] + "':" + err.Error())
-			}
+			perBank[asset.History[0]] += asset.Value
+		} else {
+			perBank[asset.History[0]] += restSum
+		}
 
-			// commit claim balance to the bank
-			err = t.updateUserBalance(stub, IndexBank, asset.History[0],  asset.Value, false)
+		if asset.Value <= restSum {
+			// move asset to shop and to bank since it shops claim
+			err = t.createClaim(stub, shopCn, userCn, asset, now)
 			if err != nil {
-				return errors.New("Error updating bank balance: " + err.Error())
+				return err
 			}
 
 			err = t.removeAsset(stub, IndexCustomerAsset, userCn, sourceCn, id)
@@ -288,28 +343,17 @@ func (t *LoyaltyChaincode) withdrawUserAssets(stub shim.ChaincodeStubInterface,
 			}
 			restSum -= asset.Value
 		} else {
-			_, err = t.storeAsset(stub, IndexCustomerAsset, userCn, sourceCn, id, asset.History, asset.Value - restSum)
+			rest := asset
+			rest.Value = asset.Value - restSum
+			_, err = t.storeAsset(stub, IndexCustomerAsset, userCn, sourceCn, id, rest)
 			if err != nil {
 				return errors.New("Error updating Asset '" + userCn + "-" + sourceCn + "-" + id+ "':" + err.Error())
 			}
-			// move asset to shop
-			asset.History = append(asset.History, userCn)
-			_, err = t.createAsset(stub, IndexShopAsset, shopCn, userCn, asset.History, restSum)
-			if err != nil {
-				return errors.New("Error creating Asset for '" + shopCn + "':" + err.Error())
-			}
-
-			// move asset to bank since it shops claim
-			asset.History = append(asset.History, shopCn)
-			_, err = t.createAsset(stub, IndexBankAsset, asset.History[0], shopCn, asset.History, restSum)
-			if err != nil {
-				return errors.New("Error creating Asset for '" + asset.History[0] + "':" + err.Error())
-			}
-
-			// commit claim balance to the bank
-			err = t.updateUserBalance(stub, IndexBank, asset.History[0], restSum, false)
+			// move asset to shop and to bank since it shops claim
+			asset.Value = restSum
+			err = t.createClaim(stub, shopCn, userCn, asset, now)
 			if err != nil {
-				return errors.New("Error updating bank balance: " + err.Error())
+				return err
 			}
 
 			restSum = 0
@@ -324,19 +368,140 @@ func (t *LoyaltyChaincode) withdrawUserAssets(stub shim.ChaincodeStubInterface,
 		return errors.New("User Balance and the sum of his assets have different amount of tokens")
 	}
 
+	// commit the claim balance once per bank
+	for _, bankCn := range banks {
+		err = t.updateUserBalance(stub, IndexBank, bankCn, perBank[bankCn], false, Movement{LedgerWithdraw, shopCn, memo})
+		if err != nil {
+			return errors.New("Error updating bank balance: " + err.Error())
+		}
+	}
+
+	// the withdrawn points left the customers, the redemption is unlocked on the banks they came from first
+	unlocked, err := t.unlockPending(stub, userCn, claim, perBank)
+	if err != nil {
+		return err
+	}
+
+	deltas := liabilityDeltas{}
+	for _, bankCn := range banks {
+		deltas.of(bankCn).outstanding.down(perBank[bankCn])
+		deltas.of(bankCn).claimed.up(perBank[bankCn])
+	}
+	for bankCn, value := range unlocked {
+		deltas.of(bankCn).outstanding.up(value)
+		deltas.of(bankCn).pending.down(value)
+	}
+	err = t.changeLiabilities(stub, deltas)
+	if err != nil {
+		return errors.New("Error updating liability: " + err.Error())
+	}
 
 	// update shop balance
-	err = t.updateUserBalance(stub, IndexShop, shopCn, claim, false)
+	err = t.updateUserBalance(stub, IndexShop, shopCn, claim, false, Movement{LedgerWithdraw, userCn, memo})
 	if err != nil {
 		return errors.New("Error setting to or from userBalance: " + err.Error())
 	}
 
-	_, err = t.updateAllowance(stub, IndexShopAllowances, shopCn, userCn, claim, true)
+	_, err = t.updateAllowance(stub, IndexShopAllowances, shopCn, userCn, claim, true, 0)
 	if err != nil {
 		return err
 	}
 
-	_, err = t.updateAllowance(stub, IndexCustomerAllowances, userCn, shopCn, claim, true)
+	_, err = t.updateAllowance(stub, IndexCustomerAllowances, userCn, shopCn, claim, true, 0)
 
 	return err
+}
+
+// reverses a withdrawal, the customer gets the assets back with their history and the claims are reduced
+func (t *LoyaltyChaincode) refundUserAssets(stub shim.ChaincodeStubInterface, userCn string, shopCn string, value uint64, memo string) error {
+
+	batched, err := t.batchedClaims(stub)
+	if err != nil {
+		return err
+	}
+
+	named, err := t.namedClaims(stub, shopCn)
+	if err != nil {
+		return err
+	}
+
+	// claims which are being settled can't be refunded, neither on the shop nor on the bank side
+	parts, err := t.consumeAssets(stub, IndexShopAsset, shopCn, value, func(entry assetEntry) bool {
+		return entry.Spender == userCn && !batched[batchedClaimKey(entry.Asset.History[0], entry.Asset.Claim)]
+	})
+	if err != nil {
+		return errors.New("Refund is bigger then withdrawn from '" + userCn + "': " + err.Error())
+	}
+
+	var banks []string
+	perBank := map[string]uint64{}
+	unnamed := map[string]uint64{}
+	for _, part := range parts {
+		bankCn := part.Asset.History[0]
+		if _, ok := perBank[bankCn]; !ok {
+			banks = append(banks, bankCn)
+		}
+		perBank[bankCn] += part.Asset.Value
+
+		if part.Asset.Claim == "" {
+			unnamed[bankCn] += part.Asset.Value
+			continue
+		}
+
+		// the shop asset names its claim
+		id := part.Asset.Claim
+		_, err = t.consumeAssets(stub, IndexBankAsset, bankCn, part.Asset.Value, func(entry assetEntry) bool {
+			return entry.Spender == shopCn && entry.Id == id
+		})
+		if err != nil {
+			return errors.New("Error reducing claim '" + id + "' of bank '" + bankCn + "': " + err.Error())
+		}
+	}
+
+	for _, bankCn := range banks {
+
+		// shop assets withdrawn before claims were named are matched by value
+		if unnamed[bankCn] > 0 {
+			_, err = t.consumeAssets(stub, IndexBankAsset, bankCn, unnamed[bankCn], func(entry assetEntry) bool {
+				history := entry.Asset.History
+				return entry.Spender == shopCn && history[len(history) - 2] == userCn && !batched[batchedClaimKey(bankCn, entry.Id)] && !named[entry.Id]
+			})
+			if err != nil {
+				return errors.New("Error reducing claims of bank '" + bankCn + "': " + err.Error())
+			}
+		}
+
+		err = t.updateUserBalance(stub, IndexBank, bankCn, perBank[bankCn], true, Movement{LedgerRefund, shopCn, memo})
+		if err != nil {
+			return errors.New("Error updating bank balance: " + err.Error())
+		}
+
+		deltas := liabilityDeltas{}
+		deltas.of(bankCn).outstanding.up(perBank[bankCn])
+		deltas.of(bankCn).claimed.down(perBank[bankCn])
+		err = t.changeLiabilities(stub, deltas)
+		if err != nil {
+			return errors.New("Error updating liability: " + err.Error())
+		}
+	}
+
+	for _, part := range parts {
+		asset := part.Asset
+
+		// move asset back to the customer
+		asset.History = append(asset.History, shopCn)
+		asset.ClaimedAt = 0
+		asset.Claim = ""
+		_, err = t.createAsset(stub, IndexCustomerAsset, userCn, shopCn, asset)
+		if err != nil {
+			return errors.New("Error creating Asset for '" + userCn + "':" + err.Error())
+		}
+	}
+
+	err = t.updateUserBalance(stub, IndexShop, shopCn, value, true, Movement{LedgerRefund, userCn, memo})
+	if err != nil {
+		return errors.New("Error updating shop balance: " + err.Error())
+	}
+
+	return t.updateUserBalance(stub, IndexCustomer, userCn, value, false, Movement{LedgerRefund, shopCn, memo})
 }
\ No newline at end of file
@@ -64,3 +64,31 @@ h1gwHwYDVR0jBBgwFoAUF2dCPaqegj/ExR2fW8OZ0bWcSBAwCgYIKoZIzj0EAwID
 RwAwRAIgJP9ARAqRHl6f2KxB+YJ6ICA9YyYAEkqRnBY4UcTMSIUCID7LFYDewEj3
 LmQ6Yvctwv0WEeTCLAuRSmPZL9+hNzX+
 -----END CERTIFICATE-----`
+
+// certificates with the role attribute 'loyalty.role' set by the Fabric CA
+const TestCustomerCN = "testCustomer"
+const TestShopCN = "testShop"
+
+const TestCustomerCert = `-----BEGIN CERTIFICATE-----
+MIIBqzCCAVKgAwIBAgIBZDAKBggqhkjOPQQDAjAXMRUwEwYDVQQDEwx0ZXN0Q3Vz
+dG9tZXIwHhcNMTkwMTAxMDAwMDAwWhcNMzkwMTAxMDAwMDAwWjAXMRUwEwYDVQQD
+Ewx0ZXN0Q3VzdG9tZXIwWTATBgcqhkjOPQIBBggqhkjOPQMBBwNCAARd1E/5yQuN
+nQwWcf+MyM/hOvBzjNMKoH0vDE8r9ernXlT4KkWbjliWQoyMySGyt7rCmqmop85D
+nNrD99ZqSeTRo4GOMIGLMA4GA1UdDwEB/wQEAwIHgDB5BggqAwQFBgcIAQRteyJh
+dHRycyI6eyJoZi5BZmZpbGlhdGlvbiI6IiIsImhmLkVucm9sbG1lbnRJRCI6InRl
+c3RDdXN0b21lciIsImhmLlR5cGUiOiJjbGllbnQiLCJsb3lhbHR5LnJvbGUiOiJj
+dXN0b21lciJ9fTAKBggqhkjOPQQDAgNHADBEAiBOM1WmS1A4I910qeyl8+1j7P4J
+JoKbj/+TXCZWEfaOWAIgWbOx1jq0Wpu+DcSWwVN4cZ0rgB8QOtXlZKuvwQH0xyc=
+-----END CERTIFICATE-----`
+
+const TestShopCert = `-----BEGIN CERTIFICATE-----
+MIIBnDCCAUKgAwIBAgIBZTAKBggqhkjOPQQDAjATMREwDwYDVQQDEwh0ZXN0U2hv
+cDAeFw0xOTAxMDEwMDAwMDBaFw0zOTAxMDEwMDAwMDBaMBMxETAPBgNVBAMTCHRl
+c3RTaG9wMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEXdRP+ckLjZ0MFnH/jMjP
+4Trwc4zTCqB9LwxPK/Xq515U+CpFm45YlkKMjMkhsre6wpqpqKfOQ5zaw/fWaknk
+0aOBhjCBgzAOBgNVHQ8BAf8EBAMCB4AwcQYIKgMEBQYHCAEEZXsiYXR0cnMiOnsi
+aGYuQWZmaWxpYXRpb24iOiIiLCJoZi5FbnJvbGxtZW50SUQiOiJ0ZXN0U2hvcCIs
+ImhmLlR5cGUiOiJjbGllbnQiLCJsb3lhbHR5LnJvbGUiOiJzaG9wIn19MAoGCCqG
+SM49BAMCA0gAMEUCIAqoC3wOqSwezXf1kFaxUPcHe2nrJWs16I29ZBsq0ZWuAiEA
+k5Cwg/HKcVLMCM9nWL74hYDn0sSR3StfSUdy7Ms8LYo=
+-----END CERTIFICATE-----`
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
 	"errors"
 )
 
@@ -31,20 +33,242 @@ func (t *LoyaltyChaincode) userExists(stub shim.ChaincodeStubInterface, cn strin
 	return true
 }
 
-func (t *LoyaltyChaincode) createUser(stub shim.ChaincodeStubInterface, cn string, role string) error {
-	var err error
-	switch role {
-	case "customer":
-		err = t.setInitUserBalance(stub, IndexCustomer, cn, 0)
-	case "bank":
-		err = t.setInitUserBalance(stub, IndexBank, cn, 0)
-	case "shop":
-		err = t.setInitUserBalance(stub, IndexShop, cn, 0)
+func validRole(role string) bool {
+	return role == "customer" || role == "bank" || role == "shop"
+}
+
+// the registry record of the identity, actors created before the registry get one derived from their balances
+func (t *LoyaltyChaincode) getActor(stub shim.ChaincodeStubInterface, id string) (*Actor, error) {
+	actor, err := t.findActor(stub, id)
+	if err == nil && actor == nil {
+		return nil, errors.New("Actor '" + id + "' doesn't exist")
+	}
+	return actor, err
+}
+
+// like getActor, but an unknown identity is no error and gives no actor
+func (t *LoyaltyChaincode) findActor(stub shim.ChaincodeStubInterface, id string) (*Actor, error) {
+	key, _ := stub.CreateCompositeKey(IndexActor, []string{id})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Error fetching actor:" + err.Error())
+	}
+
+	if data == nil {
+		actor := Actor{Id: id, Status: ActorActive}
+		for _, role := range []string{"customer", "bank", "shop"} {
+			if t.userExists(stub, id, role) {
+				actor.Roles = append(actor.Roles, role)
+			}
+		}
+		if len(actor.Roles) == 0 {
+			return nil, nil
+		}
+		return &actor, nil
+	}
+
+	actor := Actor{}
+	err = json.Unmarshal(data, &actor)
+	if err != nil {
+		return nil, errors.New("Error parsing actor:" + err.Error())
+	}
+
+	return &actor, nil
+}
+
+func (t *LoyaltyChaincode) putActor(stub shim.ChaincodeStubInterface, actor *Actor) ([]byte, error) {
+	// the profile has its own key and is never stored with the actor
+	stored := *actor
+	stored.Profile = nil
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexActor, []string{actor.Id})
+	return data, stub.PutState(key, data)
+}
+
+// creates the roles of an identity with a zero balance, an existing role is rejected instead of reset
+func (t *LoyaltyChaincode) createActor(stub shim.ChaincodeStubInterface, id string, roles []string, metadata map[string]string, profile *Profile) (*Actor, error) {
+	actor, err := t.findActor(stub, id)
+	if err != nil {
+		return nil, err
+	} else if actor == nil {
+		now, err := txTime(stub)
+		if err != nil {
+			return nil, err
+		}
+		actor = &Actor{Id: id, Status: ActorActive, CreatedTx: stub.GetTxID(), CreatedAt: now}
+	}
+
+	seen := map[string]bool{}
+	for _, role := range roles {
+		if !validRole(role) {
+			return nil, errors.New("Unknown role '" + role + "', expected customer, bank or shop")
+		}
+		if seen[role] || t.userExists(stub, id, role) {
+			return nil, errors.New("'" + id + "' already exists as " + role)
+		}
+		seen[role] = true
+	}
+
+	for _, role := range roles {
+		var prefix string
+		switch role {
+		case "customer":
+			prefix = IndexCustomer
+		case "bank":
+			prefix = IndexBank
+		case "shop":
+			prefix = IndexShop
+		}
+
+		err = t.setInitUserBalance(stub, prefix, id, 0)
+		if err != nil {
+			return nil, errors.New("Error creating user '" + id + "' with the role '" + role + "': " + err.Error())
+		}
+		actor.Roles = append(actor.Roles, role)
+	}
+
+	if len(metadata) > 0 && actor.Metadata == nil {
+		actor.Metadata = map[string]string{}
+	}
+	for k, v := range metadata {
+		actor.Metadata[k] = v
+	}
+
+	err = t.putIdentity(stub, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.putActor(stub, actor)
+	if err != nil {
+		return nil, errors.New("Error saving actor '" + id + "': " + err.Error())
+	}
+
+	if profile != nil {
+		actor.Profile, err = t.updateProfile(stub, actor, profile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return actor, nil
+}
+
+// changes the metadata of an actor, allowed for the admin and the actor itself
+func (t *LoyaltyChaincode) updateActor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("updateActor expected 1 argument")
 	}
 
+	caller, err := CallerId(stub)
 	if err != nil {
-		return errors.New("Error creating user '" + cn + "' with the role '" + role + "': " + err.Error())
+		return shim.Error("Error extracting user identity")
 	}
 
-	return nil
-}
\ No newline at end of file
+	update := ActorUpdate{}
+	err = json.Unmarshal([]byte(args[0]), &update)
+	if err != nil {
+		return shim.Error("Error parsing arguments")
+	}
+
+	if update.Id == "" {
+		update.Id = caller
+	}
+	err = t.resolveActors(stub, &update.Id)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	if update.Id != caller && !settings.isAdmin(caller) {
+		return shim.Error("Only the admin or the actor itself can update an actor")
+	}
+
+	actor, err := t.getActor(stub, update.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if actor.Metadata == nil {
+		actor.Metadata = map[string]string{}
+	}
+	for k, v := range update.Metadata {
+		if v == "" {
+			delete(actor.Metadata, k)
+		} else {
+			actor.Metadata[k] = v
+		}
+	}
+
+	_, err = t.putActor(stub, actor)
+	if err != nil {
+		return shim.Error("Error saving actor: " + err.Error())
+	}
+
+	if update.Profile != nil {
+		actor.Profile, err = t.updateProfile(stub, actor, update.Profile)
+	} else {
+		actor.Profile, err = t.getProfile(stub, actor.Id)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, _ := json.Marshal(actor)
+	return shim.Success(data)
+}
+
+// the registry record of an actor, for the admin and the actor itself
+func (t *LoyaltyChaincode) getActorInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerId(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	request := ActorUpdate{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &request)
+		if err != nil {
+			return shim.Error("Error parsing arguments")
+		}
+	}
+
+	if request.Id == "" {
+		request.Id = caller
+	}
+	err = t.resolveActors(stub, &request.Id)
+	if err != nil {
+		return shim.Error("Bad request: " + err.Error())
+	}
+
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return shim.Error("Error getting settings")
+	}
+
+	if request.Id != caller && !settings.isAdmin(caller) {
+		return shim.Error("Only the admin or the actor itself can read an actor")
+	}
+
+	actor, err := t.getActor(stub, request.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	actor.Profile, err = t.getProfile(stub, actor.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, _ := json.Marshal(actor)
+	return shim.Success(data)
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/protos/msp"
 	"strconv"
-	"math/rand"
+	"strings"
 )
 
 func parsePEM(certPEM string) (*x509.Certificate, error) {
@@ -29,26 +31,101 @@ func CNFromX509(certPEM string) (string, error) {
 	return cert.Subject.CommonName, nil
 }
 
-// extracts CN from caller of a chaincode function
-func CallerCN(stub shim.ChaincodeStubInterface) (string, error) {
+// separates MSP ID and CN in an identity, MSP IDs never contain it
+const identitySeparator = "/"
+
+// the identity of an actor used in all keys: "<MSP ID>/<CN>"
+func IdentityOf(mspId string, cn string) string {
+	return mspId + identitySeparator + cn
+}
+
+// splits an identity into MSP ID and CN, a legacy CN-only identity has no MSP ID
+func SplitIdentity(id string) (string, string) {
+	i := strings.Index(id, identitySeparator)
+	if i < 0 {
+		return "", id
+	}
+	return id[:i], id[i+1:]
+}
+
+func isLegacyIdentity(id string) bool {
+	return !strings.Contains(id, identitySeparator)
+}
+
+// extracts the identity of the caller of a chaincode function
+func CallerId(stub shim.ChaincodeStubInterface) (string, error) {
+	mspId, cn, err := CallerIdentity(stub)
+	if err != nil {
+		return "", err
+	}
+	return IdentityOf(mspId, cn), nil
+}
+
+// extracts MSP ID and CN from caller of a chaincode function
+func CallerIdentity(stub shim.ChaincodeStubInterface) (string, string, error) {
 	data, _ := stub.GetCreator()
 	serializedId := msp.SerializedIdentity{}
 	err := proto.Unmarshal(data, &serializedId)
 	if err != nil {
-		return "", errors.New("Could not unmarshal Creator")
+		return "", "", errors.New("Could not unmarshal Creator")
 	}
 
 	cn, err := CNFromX509(string(serializedId.IdBytes))
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	return cn, nil
+	return serializedId.Mspid, cn, nil
 }
 
-func uintToString(num uint64) (string) {
-	return strconv.FormatUint(num, 10)
+// the certificate extension in which the Fabric CA stores the attributes of an identity
+var attrsOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// the attribute holding the role of an actor, e.g. 'fabric-ca-client register --id.attrs loyalty.role=customer:ecert'
+const RoleAttribute = "loyalty.role"
+
+// extracts a Fabric CA attribute from the certificate of the caller, false if the certificate doesn't carry it
+func CallerAttribute(stub shim.ChaincodeStubInterface, name string) (string, bool, error) {
+	data, _ := stub.GetCreator()
+	serializedId := msp.SerializedIdentity{}
+	err := proto.Unmarshal(data, &serializedId)
+	if err != nil {
+		return "", false, errors.New("Could not unmarshal Creator")
+	}
+
+	cert, err := parsePEM(string(serializedId.IdBytes))
+	if err != nil {
+		return "", false, errors.New("Failed to parse certificate: " + err.Error())
+	}
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(attrsOID) {
+			continue
+		}
+
+		attrs := struct {
+			Attrs map[string]string `json:"attrs"`
+		}{}
+		err = json.Unmarshal(ext.Value, &attrs)
+		if err != nil {
+			return "", false, errors.New("Failed to parse certificate attributes: " + err.Error())
+		}
+
+		value, ok := attrs.Attrs[name]
+		return value, ok, nil
+	}
+
+	return "", false, nil
 }
 
-func uint64Random() uint64 {
-	return uint64(rand.Uint32())<<32 + uint64(rand.Uint32())
+// timestamp of the running transaction in seconds, equal on all endorsing peers
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, errors.New("Could not get transaction timestamp: " + err.Error())
+	}
+	return ts.Seconds, nil
+}
+
+func uintToString(num uint64) (string) {
+	return strconv.FormatUint(num, 10)
 }